@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/schollz/progressbar/v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BackupDatabase streams the entries of the badger database saved since a version to a file, with badger's backup
+// format, and writes the manifest of the backup next to it (see GetBackupManifestPath). If there's an encryption key,
+// the backup is encrypted with it (see NewEncryptedWriter).
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database.
+//  path: file where the backup is written.
+//  since: entries with this version or newer are included. 0 for a full backup.
+//
+// Returns:
+//  manifest of the backup.
+func BackupDatabase(db *badger.DB, path string, since uint64) BackupManifest {
+	EnsureDirExists(filepath.Dir(path))
+	manifest := BackupManifest{
+		ToolVersion:   version,
+		Env:           currentConfig.Env,
+		EntityPath:    currentConfig.EntityPath,
+		ConsumerGroup: currentConfig.ConsumerGroup,
+		Messages:      CountMessagesSince(db, since),
+		SinceVersion:  since,
+		Encrypted:     encryptionKey != nil,
+		CreatedAt:     time.Now().UTC(),
+	}
+
+	file, err := os.Create(path)
+	HandleError(fmt.Sprintf("Failed to create backup file '%s'.", path), err, true)
+
+	var writer io.Writer = file
+	var encrypted *EncryptedWriter
+	if manifest.Encrypted {
+		encrypted = NewEncryptedWriter(file, encryptionKey)
+		writer = encrypted
+	}
+
+	// badger's iterator skips the entries with the version it's given (it only reads versions newer than
+	// Stream.SinceTs), so the version before 'since' is given, for the entries saved with 'since' to be included.
+	badgerSince := since
+	if since > 0 {
+		badgerSince = since - 1
+	}
+
+	pBar = progressbar.DefaultBytes(-1, "Writing backup...")
+	last, err := db.Backup(io.MultiWriter(writer, pBar), badgerSince)
+	if err == nil && encrypted != nil {
+		err = encrypted.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	HandleError(fmt.Sprintf("Failed to write backup file '%s'.", path), err, true)
+
+	// badger returns 0 when there was nothing new to back up.
+	manifest.NextSinceVersion = since
+	if last > 0 && last >= since {
+		manifest.NextSinceVersion = last + 1
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	HandleError("Failed to create backup manifest.", err, true)
+	err = ioutil.WriteFile(GetBackupManifestPath(path), data, 0644)
+	HandleError(fmt.Sprintf("Failed to write backup manifest '%s'.", GetBackupManifestPath(path)), err, true)
+
+	return manifest
+}
+
+// RestoreDatabase loads a backup created by BackupDatabase into the badger database. Entries already in the
+// database are kept, unless the backup has newer versions of them. Incremental backups must be restored after the
+// backups they were taken from, in the same order. Encrypted backups are decrypted with the encryption key.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database. no other operation may use it while it's restored.
+//  path: backup file.
+//
+// Returns:
+//  manifest of the backup.
+func RestoreDatabase(db *badger.DB, path string) BackupManifest {
+	manifest := ReadBackupManifest(path)
+
+	file, err := os.Open(path)
+	HandleError(fmt.Sprintf("Failed to open backup file '%s'.", path), err, true)
+	defer file.Close()
+
+	info, err := file.Stat()
+	HandleError(fmt.Sprintf("Failed to read backup file '%s'.", path), err, true)
+
+	pBar = progressbar.DefaultBytes(info.Size(), "Restoring backup...")
+	var reader io.Reader = io.TeeReader(file, pBar)
+	if manifest.Encrypted {
+		reader = NewEncryptedReader(reader, encryptionKey)
+	}
+	err = db.Load(reader, backupMaxPendingWrites)
+	HandleError(fmt.Sprintf("Failed to restore backup file '%s'.", path), err, true)
+
+	return manifest
+}
+
+// ReadBackupManifest reads the manifest of a backup file.
+// Will panic in case of failure.
+//
+// Parameters:
+//  path: backup file.
+//
+// Returns:
+//  manifest of the backup.
+func ReadBackupManifest(path string) BackupManifest {
+	manifestPath := GetBackupManifestPath(path)
+	data, err := ioutil.ReadFile(manifestPath)
+	HandleError(fmt.Sprintf("Failed to read backup manifest '%s'.", manifestPath), err, true)
+
+	manifest := BackupManifest{}
+	err = json.Unmarshal(data, &manifest)
+	HandleError(fmt.Sprintf("Failed to parse backup manifest '%s'.", manifestPath), err, true)
+
+	return manifest
+}
+
+// GetBackupManifestPath returns the path of the manifest of a backup file.
+//
+// Parameters:
+//  path: backup file.
+//
+// Returns:
+//  path of the manifest: the backup file with the '.manifest.json' extension added.
+func GetBackupManifestPath(path string) string {
+	return path + backupManifestSuffix
+}
+
+// GetDefaultBackupFile returns the backup file used when none is configured: a file named after the env and the
+// current time, in the current directory.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  path of the backup file.
+func GetDefaultBackupFile() string {
+	return fmt.Sprintf("%s--%s.bak", currentConfig.Env, time.Now().Format("2006-01-02T15-04-05"))
+}
+
+// CountMessagesSince counts the messages saved to badgerDb since a version, without reading their values.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database.
+//  since: messages with this version or newer are counted. 0 to count every message.
+//
+// Returns:
+//  number of messages.
+func CountMessagesSince(db *badger.DB, since uint64) int {
+	count := 0
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if !IsReservedKey(iter.Item().Key()) && iter.Item().Version() >= since {
+				count++
+			}
+		}
+		return nil
+	})
+
+	HandleError("Failed to count messages.", err, true)
+	return count
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"hash/fnv"
+	"log"
+	"math"
+	"time"
+)
+
+// NewMessageWriter creates a MessageWriter.
+//
+// Parameters:
+//  db: badger database where messages will be saved.
+//  size: max number of messages kept in memory before they're flushed to the database.
+//  filter: duplicate filter. if nil, every message is looked up in the database before being saved.
+//
+// Returns:
+//  new instance of MessageWriter.
+func NewMessageWriter(db *badger.DB, size int, filter *DedupFilter) *MessageWriter {
+	return &MessageWriter{
+		db:          db,
+		batchSize:   size,
+		filter:      filter,
+		checkpoints: make(map[string]Message),
+	}
+}
+
+// Pending returns how many messages are waiting to be flushed.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of MessageWriter.
+//
+// Returns:
+//  number of messages waiting to be flushed.
+func (w *MessageWriter) Pending() int {
+	return len(w.pending)
+}
+
+// Add queues a Message to be saved. If the batch is full, it's flushed right away.
+// Will panic in case of failure.
+//
+// Parameters:
+//  msg: Message that will be saved.
+//
+// Receiver:
+//  Instance of MessageWriter.
+//
+// Returns:
+//  Nothing.
+func (w *MessageWriter) Add(msg Message) {
+	w.pending = append(w.pending, msg)
+	if msg.PartitionId != "" && !w.DisableCheckpoints {
+		w.checkpoints[GetPartitionLabel(msg.Source, msg.PartitionId)] = msg
+	}
+
+	if len(w.pending) >= w.batchSize {
+		w.Flush()
+	}
+}
+
+// Flush saves every pending Message that matches the filter and is not in the database yet, together with its index
+// keys and, for the last Message of each partition, the checkpoint of the partition. They're written in the same
+// transaction, so a checkpoint never points past a message that was not saved. When the batch doesn't fit in a
+// single transaction, the messages that fit are committed and the rest go to a new one.
+// Will panic in case of failure.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of MessageWriter.
+//
+// Returns:
+//  Nothing.
+func (w *MessageWriter) Flush() {
+	if len(w.pending) == 0 || !StillHaveConnection(w.db) {
+		return
+	}
+
+	results := make([]WriteResult, len(w.pending))
+	for i, msg := range w.pending {
+		if !messageFilter.Matches(msg) {
+			results[i] = writeResultSkipped
+		}
+	}
+
+	existing := w.findExistingKeys(results)
+	batchKeys := make(map[string]bool, len(w.pending))
+	checkpoints := w.getCheckpointIndexes()
+
+	txn := w.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+
+	var inTxn []int
+	for i := range w.pending {
+		msg := &w.pending[i]
+		key := msg.Key
+		isNew := results[i] != writeResultSkipped && !existing[key] && !batchKeys[key]
+		if !isNew && !checkpoints[i] {
+			continue
+		}
+
+		if isNew {
+			msg.ElapsedTime = fmt.Sprintf("%s", time.Since(msg.ProcessedAt))
+			results[i] = writeResultStored
+			batchKeys[key] = true
+		}
+
+		err := w.writeMessage(txn, i, results[i], checkpoints[i])
+		if err == badger.ErrTxnTooBig {
+			// Entries of this Message may already be in the transaction, so it's written again without them.
+			txn.Discard()
+			txn = w.db.NewTransaction(true)
+			for _, j := range inTxn {
+				err = w.writeMessage(txn, j, results[j], checkpoints[j])
+				HandleError("Failed to add Message to transaction.", err, true)
+			}
+			HandleError("Failed to save messages to database.", txn.Commit(), true)
+
+			txn = w.db.NewTransaction(true)
+			inTxn = inTxn[:0]
+			err = w.writeMessage(txn, i, results[i], checkpoints[i])
+		}
+		HandleError("Failed to add Message to transaction.", err, true)
+
+		inTxn = append(inTxn, i)
+		if isNew && w.filter != nil {
+			w.filter.Add([]byte(key))
+		}
+	}
+
+	HandleError("Failed to save messages to database.", txn.Commit(), true)
+
+	if currentConfig.ReadToFile && dumpPool != nil {
+		for i, msg := range w.pending {
+			if results[i] == writeResultStored {
+				dumpPool.Submit(msg)
+			}
+		}
+	}
+
+	for _, msg := range w.checkpoints {
+		if balancer, found := leaseBalancers[msg.Source]; found {
+			balancer.SaveCheckpoint(msg)
+		}
+	}
+
+	if w.OnWritten != nil {
+		for i, msg := range w.pending {
+			w.OnWritten(msg, results[i])
+		}
+	}
+
+	w.pending = w.pending[:0]
+	w.checkpoints = make(map[string]Message)
+}
+
+// writeMessage adds a pending Message to a transaction: the Message and its index keys, if it's new, and the
+// checkpoint of its partition, if asked to.
+//
+// Parameters:
+//  txn: transaction where the Message is written.
+//  i: position of the Message in the pending messages.
+//  result: what happens to the Message. only stored messages are written.
+//  checkpoint: true to save the Message as the checkpoint of its partition.
+//
+// Receiver:
+//  Instance of MessageWriter.
+//
+// Returns:
+//  error if it could not be added. badger.ErrTxnTooBig if it doesn't fit in the transaction.
+func (w *MessageWriter) writeMessage(txn *badger.Txn, i int, result WriteResult, checkpoint bool) error {
+	msg := w.pending[i]
+	if result == writeResultStored {
+		expiresAt := GetExpiresAt(msg)
+		if err := txn.SetEntry(NewStoredEntry([]byte(msg.Key), msg.Serialize(), expiresAt)); err != nil {
+			return err
+		}
+		if err := SetIndexKeys(txn, msg, expiresAt); err != nil {
+			return err
+		}
+	}
+
+	if checkpoint {
+		return SaveCheckpoint(txn, msg)
+	}
+
+	return nil
+}
+
+// getCheckpointIndexes finds the pending messages that will be saved as the checkpoints of their partitions: the last
+// one of each partition.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of MessageWriter.
+//
+// Returns:
+//  set with the positions of those messages in the pending messages.
+func (w *MessageWriter) getCheckpointIndexes() map[int]bool {
+	indexes := make(map[int]bool, len(w.checkpoints))
+	if w.DisableCheckpoints {
+		return indexes
+	}
+
+	last := make(map[string]int, len(w.checkpoints))
+	for i, msg := range w.pending {
+		if msg.PartitionId != "" {
+			last[GetPartitionLabel(msg.Source, msg.PartitionId)] = i
+		}
+	}
+	for _, i := range last {
+		indexes[i] = true
+	}
+
+	return indexes
+}
+
+// findExistingKeys looks up in the database the keys of pending messages that might already be there.
+// Keys that the duplicate filter knows are not in the database, and messages that will be skipped, are not
+// looked up.
+// Will panic in case of failure.
+//
+// Parameters:
+//  results: what will happen to each pending message, so far.
+//
+// Receiver:
+//  Instance of MessageWriter.
+//
+// Returns:
+//  set with the keys that are already in the database.
+func (w *MessageWriter) findExistingKeys(results []WriteResult) map[string]bool {
+	existing := make(map[string]bool)
+
+	err := w.db.View(func(txn *badger.Txn) error {
+		for i, msg := range w.pending {
+			key := []byte(msg.Key)
+			if results[i] == writeResultSkipped || (w.filter != nil && !w.filter.MayContain(key)) {
+				continue
+			}
+
+			_, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			existing[msg.Key] = true
+		}
+		return nil
+	})
+
+	HandleError("Failed to look for duplicated messages.", err, true)
+	return existing
+}
+
+// NewDedupFilter creates an empty DedupFilter sized for about 1% false positives.
+//
+// Parameters:
+//  capacity: number of keys the filter is expected to hold.
+//
+// Returns:
+//  new instance of DedupFilter.
+func NewDedupFilter(capacity int) *DedupFilter {
+	size := uint64(math.Ceil(float64(capacity) * 9.6))
+	if size < 64 {
+		size = 64
+	}
+
+	return &DedupFilter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: 7,
+	}
+}
+
+// LoadDedupFilter creates a DedupFilter with every Message key already saved to the database.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database that will be scanned.
+//
+// Returns:
+//  DedupFilter with every key in the database. nil if the filter is disabled.
+func LoadDedupFilter(db *badger.DB) *DedupFilter {
+	if currentConfig.DisableDedupFilter {
+		return nil
+	}
+
+	filter := NewDedupFilter(currentConfig.DedupFilterCapacity)
+	loaded := 0
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := iter.Item().Key()
+			if IsReservedKey(key) {
+				continue
+			}
+			filter.Add(key)
+			loaded++
+		}
+		return nil
+	})
+
+	HandleError("Failed to load duplicate filter.", err, true)
+	log.Printf("Duplicate filter loaded with %d keys.\n", loaded)
+	return filter
+}
+
+// Add registers a key in the filter.
+//
+// Parameters:
+//  key: key that will be added.
+//
+// Receiver:
+//  Instance of DedupFilter.
+//
+// Returns:
+//  Nothing.
+func (f *DedupFilter) Add(key []byte) {
+	h1, h2 := f.hash(key)
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain checks if a key might have been added to the filter.
+//
+// Parameters:
+//  key: key that will be checked.
+//
+// Receiver:
+//  Instance of DedupFilter.
+//
+// Returns:
+//  false if the key was certainly not added. true if it might have been.
+func (f *DedupFilter) MayContain(key []byte) bool {
+	h1, h2 := f.hash(key)
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hash calculates the two base hashes used to derive every bit position of a key.
+//
+// Parameters:
+//  key: key that will be hashed.
+//
+// Receiver:
+//  Instance of DedupFilter.
+//
+// Returns:
+//  the two base hashes of the key.
+func (f *DedupFilter) hash(key []byte) (uint64, uint64) {
+	h1 := fnv.New64a()
+	_, _ = h1.Write(key)
+	h2 := fnv.New64()
+	_, _ = h2.Write(key)
+
+	return h1.Sum64(), h2.Sum64() | 1
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/schollz/progressbar/v3"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// GenerateFakeEvents creates events similar to the ones received from eventhub, spread across 4 partitions.
+// About 5% of them are duplicates of a previous event, like what happens when reading is restarted.
+//
+// Parameters:
+//  count: number of events that will be created.
+//
+// Returns:
+//  list of fake events.
+func GenerateFakeEvents(count int) []FakeEvent {
+	const partitions = 4
+	runId := time.Now().UnixNano()
+	events := make([]FakeEvent, 0, count)
+
+	for i := 0; i < count; i++ {
+		if i%20 == 19 {
+			events = append(events, events[i/2])
+			continue
+		}
+
+		seq := int64(i / partitions)
+		offset := seq * 1024
+		enqueuedTime := time.Now()
+		eventId := fmt.Sprintf("benchmark-%d-%08d", runId, i)
+		event := eventhub.NewEvent([]byte(fmt.Sprintf(`{"id":"%s","tenant":"tenant-%d","value":%d,"ts":"%s"}`,
+			eventId, i%10, i, enqueuedTime.Format(time.RFC3339Nano))))
+		event.ID = eventId
+		event.Set(contentTypeProperty, contentTypeJson)
+		event.SystemProperties = &eventhub.SystemProperties{
+			SequenceNumber: &seq,
+			Offset:         &offset,
+			EnqueuedTime:   &enqueuedTime,
+		}
+
+		events = append(events, FakeEvent{PartitionId: strconv.Itoa(i % partitions), Event: event})
+	}
+
+	return events
+}
+
+// RunWriteBenchmark receives events into a temporary database, that is deleted afterwards, and measures the
+// throughput. Events go through the same handler and routine used by read (OnMsgReceived and ProcessMessage).
+// Will panic in case of failure.
+//
+// Parameters:
+//  name: description of the benchmark. used in the results.
+//  events: events that will be received.
+//  size: max number of messages in each batch.
+//  useFilter: if true, a duplicate filter will be used to skip database lookups.
+//
+// Returns:
+//  number of messages saved per second.
+func RunWriteBenchmark(name string, events []FakeEvent, size int, useFilter bool) float64 {
+	tmpDir, err := ioutil.TempDir("", "hubtools-benchmark-")
+	HandleError("Failed to create temporary benchmark directory.", err, true)
+	defer func() {
+		HandleError("Failed to remove temporary benchmark directory.", os.RemoveAll(tmpDir), true)
+	}()
+
+	realConfig := currentConfig
+	defer func() { currentConfig = realConfig }()
+	currentConfig.BadgerBase = tmpDir
+	currentConfig.BadgerDir = filepath.Join(tmpDir, "dir")
+	currentConfig.BadgerValueDir = filepath.Join(tmpDir, "valueDir")
+	currentConfig.ReadToFile = false
+	currentConfig.BatchSize = size
+	currentConfig.DisableDedupFilter = !useFilter
+	currentConfig.MaxMessages = 0
+	currentConfig.StartPosition = ""
+
+	OpenConnection()
+	defer CloseConnection()
+
+	messageChannel = make(chan Message, size)
+	readStats = NewReadStats()
+	pBar = progressbar.Default(int64(len(events)), name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	processed := make(chan struct{})
+	started := time.Now()
+	go ProcessMessage(ctx, processed)
+
+	source := currentConfig.Sources[0].Name
+	for _, event := range events {
+		HandleError("Failed to receive fake event.", OnMsgReceived(ctx, source, event.PartitionId, event.Event), true)
+	}
+	// Messages still in the channel are saved before ProcessMessage returns.
+	cancel()
+	<-processed
+	elapsed := time.Since(started)
+	_ = pBar.Close()
+
+	rate := float64(len(events)) / elapsed.Seconds()
+	log.Printf("%s: %d messages (%d new) in %s. ~%.0f messages/sec\n",
+		name, len(events), readStats.Stored, elapsed, rate)
+	return rate
+}
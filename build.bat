@@ -1,5 +1,5 @@
 set GOOS=windows
 set GOARCH=amd64
 
-go build -o hubtools.exe main.go globals.go utils.go db_utils.go eventhub_utils.go file_utils.go parsers.go validators.go wrappers.go
+go build -o hubtools.exe main.go globals.go utils.go db_utils.go eventhub_utils.go file_utils.go parsers.go validators.go wrappers.go checkpoint_utils.go read_utils.go payload_utils.go batch_utils.go benchmark_utils.go dump_utils.go hub_client_utils.go filter_utils.go key_utils.go lease_utils.go source_utils.go tail_utils.go capture_utils.go schema_utils.go protobuf_utils.go compression_utils.go index_utils.go storage_utils.go retention_utils.go encryption_utils.go backup_utils.go
 7z a -tzip az-eventhub-reader--windows-amd64--%*.zip *.exe
\ No newline at end of file
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/linkedin/goavro/v2"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListCaptureFiles returns every Avro file inside a directory, recursively, sorted by path. With the default Capture
+// naming ({Namespace}/{EventHub}/{PartitionId}/{Year}/{Month}/{Day}/{Hour}/{Minute}/{Second}), this is the order
+// the files were written for each partition.
+// Will panic if it cannot read directory.
+//
+// Parameters:
+//  dir: path to the directory that will be read.
+//
+// Returns:
+//  list of Avro files found.
+func ListCaptureFiles(dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".avro") {
+			files = append(files, path)
+		}
+		return nil
+	})
+
+	HandleError(fmt.Sprintf("Failed to list capture files in directory '%s'.", dir), err, true)
+	sort.Strings(files)
+	return files
+}
+
+// ReadCaptureFile reads every event of a Capture Avro file and passes each one, as a Message, to a callback.
+// The partition id is taken from the path or, if it doesn't follow the default Capture naming, from
+// 'capturePartition'. Files whose partition id is unknown are not read, since messages of different partitions
+// could be taken as duplicates.
+//
+// Parameters:
+//  path: path of the Avro file.
+//  onMessage: function called for each event in the file.
+//
+// Returns:
+//  number of events read and error, if the file could not be read.
+func ReadCaptureFile(path string, onMessage func(msg Message)) (int, error) {
+	partitionId := GetCapturePartitionId(path)
+	if partitionId == "" {
+		partitionId = currentConfig.CapturePartition
+	}
+	if partitionId == "" {
+		return 0, errors.New("the partition id could not be taken from the path, which doesn't follow the default " +
+			"Capture naming. Set 'capturePartition' (or -capture-partition)")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	ocf, err := goavro.NewOCFReader(f)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for ocf.Scan() {
+		record, err := ocf.Read()
+		if err != nil {
+			return count, err
+		}
+
+		fields, ok := record.(map[string]interface{})
+		if !ok {
+			return count, fmt.Errorf("record %d is not a Capture event", count+1)
+		}
+
+		msg, err := CaptureRecordToMessage(fields, partitionId)
+		if err != nil {
+			return count, fmt.Errorf("record %d is not valid: %s", count+1, err)
+		}
+
+		onMessage(msg)
+		count++
+	}
+
+	return count, ocf.Err()
+}
+
+// CaptureRecordToMessage converts a Capture event (SequenceNumber, Offset, EnqueuedTimeUtc, SystemProperties,
+// Properties and Body) to a Message.
+//
+// Parameters:
+//  fields: fields of the Avro record.
+//  partitionId: id of the partition the file was captured from.
+//
+// Returns:
+//  Message and error, if a required field is missing or invalid.
+func CaptureRecordToMessage(fields map[string]interface{}, partitionId string) (Message, error) {
+	seq, ok := fields["SequenceNumber"].(int64)
+	if !ok {
+		return Message{}, fmt.Errorf("field 'SequenceNumber' is missing")
+	}
+
+	offsetText, _ := fields["Offset"].(string)
+	offset, err := strconv.ParseInt(offsetText, 10, 64)
+	if err != nil {
+		return Message{}, fmt.Errorf("field 'Offset' is not valid: '%s'", offsetText)
+	}
+
+	enqueuedText, _ := fields["EnqueuedTimeUtc"].(string)
+	enqueuedTime, err := ParseCaptureTime(enqueuedText)
+	if err != nil {
+		return Message{}, err
+	}
+
+	body, _ := UnwrapAvroUnion(fields["Body"]).([]byte)
+	props := UnwrapAvroMap(fields["Properties"])
+	sysProps := UnwrapAvroMap(fields["SystemProperties"])
+
+	msg := Message{
+		EventId:          GetCaptureEventId(sysProps),
+		QueuedTime:       enqueuedTime,
+		EventSeqNumber:   &seq,
+		EventOffset:      &offset,
+		PartitionId:      partitionId,
+		Properties:       StringifyProperties(props),
+		SystemProperties: StringifyProperties(sysProps),
+		ProcessedAt:      time.Now(),
+		Body:             body,
+		ContentType:      GetContentType(props, body),
+		Source:           currentConfig.Sources[0].Name,
+	}
+	if partitionKey, found := sysProps["x-opt-partition-key"].(string); found {
+		msg.PartitionKey = partitionKey
+	}
+	ValidateMessage(&msg)
+	msg.Key = GetMessageKey(msg)
+	msg.DumpFilename = GetDumpMsgFilename(GetDumpMsgId(msg))
+
+	return msg, nil
+}
+
+// GetCapturePartitionId finds the partition id in the path of a Capture file, based on the default Capture naming:
+// the partition id is followed by 5 folders (year, month, day, hour and minute) and the file (second).
+//
+// Parameters:
+//  path: path of the Avro file.
+//
+// Returns:
+//  partition id. Empty if the path doesn't follow the default Capture naming.
+func GetCapturePartitionId(path string) string {
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(path)), "/")
+	if len(parts) < 7 {
+		return ""
+	}
+
+	parts[len(parts)-1] = strings.TrimSuffix(parts[len(parts)-1], filepath.Ext(path))
+	for _, part := range parts[len(parts)-7:] {
+		if _, err := strconv.Atoi(part); err != nil {
+			return ""
+		}
+	}
+
+	return parts[len(parts)-7]
+}
+
+// GetCaptureEventId returns the message id kept in the system properties of a Capture event, if there's one.
+//
+// Parameters:
+//  sysProps: system properties of the event.
+//
+// Returns:
+//  message id. Empty if there's none.
+func GetCaptureEventId(sysProps map[string]interface{}) string {
+	for _, key := range []string{"message-id", "MessageId"} {
+		if id, found := sysProps[key]; found && id != nil {
+			return fmt.Sprintf("%v", id)
+		}
+	}
+
+	return ""
+}
+
+// ParseCaptureTime parses the enqueued time of a Capture event. Capture writes it like '9/29/2021 1:04:05 PM', in UTC.
+//
+// Parameters:
+//  value: enqueued time, as written by Capture.
+//
+// Returns:
+//  enqueued time and error, if it's not valid.
+func ParseCaptureTime(value string) (time.Time, error) {
+	for _, layout := range []string{"1/2/2006 3:04:05 PM", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("field 'EnqueuedTimeUtc' is not valid: '%s'", value)
+}
+
+// UnwrapAvroMap converts an Avro map of unions, as decoded by goavro, to a map of plain values.
+//
+// Parameters:
+//  value: decoded Avro map.
+//
+// Returns:
+//  map with plain values. nil if the map is empty or missing.
+func UnwrapAvroMap(value interface{}) map[string]interface{} {
+	decoded, ok := value.(map[string]interface{})
+	if !ok || len(decoded) == 0 {
+		return nil
+	}
+
+	values := make(map[string]interface{}, len(decoded))
+	for key, v := range decoded {
+		values[key] = UnwrapAvroUnion(v)
+	}
+
+	return values
+}
+
+// UnwrapAvroUnion returns the value of an Avro union, as decoded by goavro. goavro decodes each non-null union value
+// as a map with a single entry, whose key is the type of the value. Values that are not unions are returned as they
+// are.
+//
+// Parameters:
+//  value: decoded Avro value.
+//
+// Returns:
+//  plain value.
+func UnwrapAvroUnion(value interface{}) interface{} {
+	if union, isUnion := value.(map[string]interface{}); isUnion && len(union) == 1 {
+		for _, inner := range union {
+			return inner
+		}
+	}
+
+	return value
+}
+
+// PrintImportSummary logs what was imported from Capture files.
+//
+// Parameters:
+//  files: number of files imported.
+//  failed: number of files that could not be read.
+//  processed: number of events read.
+//  stored: number of events saved to the database.
+//  skipped: number of events skipped by the filter.
+//
+// Returns:
+//  Nothing.
+func PrintImportSummary(files int, failed int, processed int64, stored int64, skipped int64) {
+	log.Println("----| SUMMARY | -----------------------------------")
+	log.Printf("Capture files imported: %d (failed: %d)\n", files, failed)
+	log.Printf("Messages processed: %d (new: %d, already in database: %d, skipped by filter: %d)\n",
+		processed, stored, processed-stored-skipped, skipped)
+	PrintDumpSummary()
+	log.Println("--------------------------------------------------")
+}
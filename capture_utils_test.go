@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCaptureRecordToMessage checks how the fields of a Capture record are mapped to a Message.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestCaptureRecordToMessage(t *testing.T) {
+	defer func() { currentConfig = Config{} }()
+	currentConfig = Config{DedupKey: dedupKeyPartitionSequence, Sources: []SourceConfig{{Name: "orders"}}}
+
+	fields := map[string]interface{}{
+		"SequenceNumber":  int64(12),
+		"Offset":          "4096",
+		"EnqueuedTimeUtc": "9/29/2021 1:04:05 PM",
+		"Body":            map[string]interface{}{"bytes": []byte(`{"tenant":"acme"}`)},
+		"Properties": map[string]interface{}{
+			"tenant": map[string]interface{}{"string": "acme"},
+			"retry":  map[string]interface{}{"int": int32(2)},
+		},
+		"SystemProperties": map[string]interface{}{
+			"message-id":          map[string]interface{}{"string": "m-1"},
+			"x-opt-partition-key": map[string]interface{}{"string": "customer-9"},
+		},
+	}
+
+	msg, err := CaptureRecordToMessage(fields, "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *msg.EventSeqNumber != 12 || *msg.EventOffset != 4096 {
+		t.Errorf("sequence number and offset are %d and %d, want 12 and 4096", *msg.EventSeqNumber, *msg.EventOffset)
+	}
+	if want := time.Date(2021, 9, 29, 13, 4, 5, 0, time.UTC); !msg.QueuedTime.Equal(want) {
+		t.Errorf("enqueued time is %s, want %s", msg.QueuedTime, want)
+	}
+	if msg.EventId != "m-1" || msg.PartitionKey != "customer-9" || msg.PartitionId != "3" || msg.Source != "orders" {
+		t.Errorf("message %+v doesn't have the ids of the record", msg)
+	}
+	if msg.Properties["tenant"] != "acme" || msg.Properties["retry"] != "2" {
+		t.Errorf("properties are %v", msg.Properties)
+	}
+	if string(msg.Body) != `{"tenant":"acme"}` || msg.ContentType != contentTypeJson {
+		t.Errorf("body is '%s' (%s)", msg.Body, msg.ContentType)
+	}
+	if msg.Key != "msg/orders/3/seq/00000000000000000012" {
+		t.Errorf("key is '%s'", msg.Key)
+	}
+
+	delete(fields, "SequenceNumber")
+	if _, err = CaptureRecordToMessage(fields, "3"); err == nil {
+		t.Error("a record without sequence number should be rejected")
+	}
+}
+
+// TestGetCapturePartitionId checks the partition id taken from the path of Capture files, with and without the default
+// Capture naming.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestGetCapturePartitionId(t *testing.T) {
+	paths := map[string]string{
+		filepath.FromSlash("capture/ns/hub/3/2021/09/29/13/04/05.avro"): "3",
+		filepath.FromSlash("ns/hub/12/2021/09/29/13/04/05.avro"):        "12",
+		filepath.FromSlash("capture/ns/hub/2021/09/29/13/04/05.avro"):   "",
+		filepath.FromSlash("capture/flat/file.avro"):                    "",
+	}
+
+	for path, want := range paths {
+		if partitionId := GetCapturePartitionId(path); partitionId != want {
+			t.Errorf("partition id of '%s' is '%s', want '%s'", path, partitionId, want)
+		}
+	}
+}
+
+// TestReadCaptureFileWithoutPartition checks that a file whose partition id is unknown is not imported.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestReadCaptureFileWithoutPartition(t *testing.T) {
+	defer func() { currentConfig = Config{} }()
+	currentConfig = Config{Sources: []SourceConfig{{Name: "orders"}}}
+
+	path := filepath.Join(t.TempDir(), "file.avro")
+	_, err := ReadCaptureFile(path, func(msg Message) {})
+	if err == nil || !strings.Contains(err.Error(), "capturePartition") {
+		t.Errorf("file without partition id should be rejected asking for 'capturePartition', error: %v", err)
+	}
+}
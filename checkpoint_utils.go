@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
+	"github.com/dgraph-io/badger/v3"
+	"strconv"
+	"strings"
+)
+
+// GetCheckpointKey returns the badger key used to store the checkpoint of a partition.
+// The key is namespaced by env, source, entity path and consumer group, so different sources never share
+// checkpoints, even if they read hubs with the same name from different namespaces.
+//
+// Parameters:
+//  source: eventhub the partition belongs to.
+//  partitionId: id of the partition.
+//
+// Returns:
+//  key used to save/load the checkpoint.
+func GetCheckpointKey(source SourceConfig, partitionId string) []byte {
+	return []byte(fmt.Sprintf("%s%s/%s/%s/%s/%s",
+		checkpointKeyPrefix,
+		currentConfig.Env,
+		source.Name,
+		source.EntityPath,
+		source.ConsumerGroup,
+		partitionId))
+}
+
+// IsReservedKey checks if a badger key is used internally by this application (checkpoints, etc.) instead
+// of holding a Message.
+//
+// Parameters:
+//  key: badger key to check.
+//
+// Returns:
+//  true if the key is reserved. false otherwise.
+func IsReservedKey(key []byte) bool {
+	return strings.HasPrefix(string(key), reservedKeyPrefix)
+}
+
+// SaveCheckpoint stores the position of a processed Message as the checkpoint of its partition.
+// Will panic in case of failure.
+//
+// Parameters:
+//  txn: badger transaction that will be used to save the checkpoint.
+//  msg: last Message processed for the partition.
+//
+// Returns:
+//  error if the checkpoint could not be saved.
+func SaveCheckpoint(txn *badger.Txn, msg Message) error {
+	if msg.PartitionId == "" || msg.EventOffset == nil || msg.EventSeqNumber == nil {
+		return nil
+	}
+
+	checkpoint := persist.NewCheckpoint(
+		strconv.FormatInt(*msg.EventOffset, 10),
+		*msg.EventSeqNumber,
+		msg.QueuedTime)
+
+	data, err := json.Marshal(checkpoint)
+	HandleError("Failed to serialize checkpoint.", err, true)
+
+	return txn.Set(GetCheckpointKey(GetSource(msg.Source), msg.PartitionId), data)
+}
+
+// LoadCheckpoint reads the last checkpoint saved for a partition.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database where the checkpoints are stored.
+//  source: eventhub the partition belongs to.
+//  partitionId: id of the partition.
+//
+// Returns:
+//  the checkpoint saved for the partition or nil if there's none.
+func LoadCheckpoint(db *badger.DB, source SourceConfig, partitionId string) *persist.Checkpoint {
+	var checkpoint *persist.Checkpoint
+
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(GetCheckpointKey(source, partitionId))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			checkpoint = &persist.Checkpoint{}
+			return json.Unmarshal(val, checkpoint)
+		})
+	})
+
+	HandleError(fmt.Sprintf("Failed to load checkpoint for partition '%s' of '%s'", partitionId, source.Name), err, true)
+	return checkpoint
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"strings"
+)
+
+// GetContentEncoding returns the compression of the payload of a Message: the one declared by the producer (via
+// application property) or, if none was declared, the one detected from the first bytes of the payload.
+//
+// Parameters:
+//  msg: Message with the payload.
+//
+// Returns:
+//  compression of the payload (gzip, deflate or zstd). empty if it's not compressed.
+func GetContentEncoding(msg Message) string {
+	for key, value := range msg.Properties {
+		if strings.EqualFold(key, encodingProperty) {
+			encoding := strings.ToLower(strings.TrimSpace(value))
+			if IsSupportedContentEncoding(encoding) {
+				return encoding
+			}
+		}
+	}
+
+	return DetectContentEncoding(msg.GetBody())
+}
+
+// DetectContentEncoding guesses the compression of a payload by its magic bytes.
+//
+// Parameters:
+//  data: payload that will be checked.
+//
+// Returns:
+//  compression of the payload (gzip, deflate or zstd). empty if none was detected.
+func DetectContentEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return contentEncodingGzip
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return contentEncodingZstd
+	case len(data) >= 2 && data[0]&0x0f == 8 && data[0]>>4 <= 7 &&
+		(uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		// zlib header: deflate method and a valid header checksum.
+		return contentEncodingDeflate
+	}
+
+	return ""
+}
+
+// IsSupportedContentEncoding checks if a compression can be decompressed and used by the write operation.
+//
+// Parameters:
+//  encoding: name of the compression.
+//
+// Returns:
+//  true if it's supported. false otherwise.
+func IsSupportedContentEncoding(encoding string) bool {
+	return Contains([]string{contentEncodingGzip, contentEncodingDeflate, contentEncodingZstd}, encoding)
+}
+
+// Decompress decompresses a payload.
+// Deflate payloads may be zlib wrapped (as HTTP does) or raw.
+//
+// Parameters:
+//  data: compressed payload.
+//  encoding: compression of the payload (gzip, deflate or zstd).
+//
+// Returns:
+//  decompressed payload and error, if it could not be decompressed.
+func Decompress(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case contentEncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+
+	case contentEncodingDeflate:
+		if reader, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		}
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+
+	case contentEncodingZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+
+	return nil, fmt.Errorf("content encoding '%s' is not supported", encoding)
+}
+
+// Compress compresses a payload.
+// Deflate payloads are zlib wrapped, as HTTP does.
+//
+// Parameters:
+//  data: payload that will be compressed.
+//  encoding: compression that will be used (gzip, deflate or zstd).
+//
+// Returns:
+//  compressed payload and error, if it could not be compressed.
+func Compress(data []byte, encoding string) ([]byte, error) {
+	compressed := &bytes.Buffer{}
+
+	switch encoding {
+	case contentEncodingGzip:
+		writer := gzip.NewWriter(compressed)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return compressed.Bytes(), nil
+
+	case contentEncodingDeflate:
+		writer := zlib.NewWriter(compressed)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return compressed.Bytes(), nil
+
+	case contentEncodingZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+
+	return nil, fmt.Errorf("content encoding '%s' is not supported", encoding)
+}
+
+// initZstd creates the zstd encoder and decoder shared by every compression and decompression. They're safe for
+// concurrent use and expensive to create, so they're created only once.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  error if they could not be created.
+func initZstd() error {
+	var err error
+	zstdOnce.Do(func() {
+		if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+			return
+		}
+		zstdDecoder, err = zstd.NewReader(nil)
+	})
+	if err == nil && (zstdEncoder == nil || zstdDecoder == nil) {
+		err = errors.New("zstd is not available")
+	}
+
+	return err
+}
+
+// GetUncompressedBody returns the payload of the Message, decompressed if it's compressed.
+// Payloads that can't be decompressed are returned as they are. The payload is only decompressed the first time, since
+// it's needed many times to display a Message.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of Message.
+//
+// Returns:
+//  payload and the compression it was decompressed from. empty if it was not decompressed.
+func (m *Message) GetUncompressedBody() ([]byte, string) {
+	if m.uncompressedBody != nil {
+		return m.uncompressedBody.data, m.uncompressedBody.encoding
+	}
+
+	m.uncompressedBody = &uncompressedBody{data: m.GetBody()}
+	if encoding := GetContentEncoding(*m); encoding != "" {
+		if data, err := Decompress(m.GetBody(), encoding); err == nil {
+			m.uncompressedBody = &uncompressedBody{data: data, encoding: encoding}
+		}
+	}
+
+	return m.uncompressedBody.data, m.uncompressedBody.encoding
+}
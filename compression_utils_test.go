@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestCompressRoundTrip checks that payloads compressed by write are detected and decompressed back.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestCompressRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"tenant":"acme","amount":10}`, 50))
+
+	for _, encoding := range []string{contentEncodingGzip, contentEncodingDeflate, contentEncodingZstd} {
+		compressed, err := Compress(payload, encoding)
+		if err != nil {
+			t.Fatalf("failed to compress with %s: %v", encoding, err)
+		}
+		if detected := DetectContentEncoding(compressed); detected != encoding {
+			t.Errorf("%s payload detected as '%s'", encoding, detected)
+		}
+
+		msg := Message{Body: compressed}
+		body, from := msg.GetUncompressedBody()
+		if from != encoding || !bytes.Equal(body, payload) {
+			t.Errorf("%s payload decompressed from '%s' to a different payload", encoding, from)
+		}
+	}
+}
+
+// TestGetUncompressedBodyDecompressesOnce checks that the payload of a Message is decompressed only the first time
+// it's needed.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestGetUncompressedBodyDecompressesOnce(t *testing.T) {
+	compressed, err := Compress([]byte(`{"amount":10}`), contentEncodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := Message{Body: compressed}
+	first, _ := msg.GetUncompressedBody()
+	// A new payload would be decompressed again, so it must not be read.
+	msg.Body = []byte("not compressed")
+	if second, encoding := msg.GetUncompressedBody(); !bytes.Equal(first, second) || encoding != contentEncodingGzip {
+		t.Error("payload was decompressed again")
+	}
+}
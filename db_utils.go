@@ -1,6 +1,9 @@
 package main
 
-import "github.com/dgraph-io/badger/v3"
+import (
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+)
 
 // StillHaveConnection helps to avoid panic errors when handling abrupt runtime interruptions (ctrl+c or stopping ide
 // run). This has to be called everytime before a database operation is performed.
@@ -35,6 +38,25 @@ func OpenConnection() *badger.DB {
 	opts.CompactL0OnClose = !currentConfig.BadgerSkipCompactL0OnClose
 	opts.ValueLogFileSize = currentConfig.BadgerValueLogFileSize
 
+	switch currentConfig.BadgerCompression {
+	case storageCompressionNone:
+		opts.Compression = options.None
+	case storageCompressionSnappy:
+		opts.Compression = options.Snappy
+	case storageCompressionZstd:
+		opts.Compression = options.ZSTD
+		if currentConfig.BadgerZstdLevel != 0 {
+			opts.ZSTDCompressionLevel = currentConfig.BadgerZstdLevel
+		}
+	}
+
+	if encryptionKey != nil {
+		opts.EncryptionKey = encryptionKey
+		opts.EncryptionKeyRotationDuration = dataKeyRotationDuration
+		// badger needs an index cache to read encrypted tables.
+		opts.IndexCacheSize = badgerIndexCacheSize
+	}
+
 	if !currentConfig.BadgerVerbose {
 		opts.Logger = nil
 	}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// NewDumpPool creates a DumpPool and starts its workers.
+//
+// Parameters:
+//  workers: number of files written at the same time.
+//  queueSize: max number of messages waiting to be written. When the queue is full, Submit blocks.
+//
+// Returns:
+//  new instance of DumpPool, ready to receive messages.
+func NewDumpPool(workers int, queueSize int) *DumpPool {
+	pool := &DumpPool{
+		jobs: make(chan DumpJob, queueSize),
+	}
+
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go pool.work()
+	}
+
+	return pool
+}
+
+// Submit queues a Message to be written to disk, in the folder of the day it was processed.
+//
+// Parameters:
+//  msg: Message that will be written.
+//
+// Receiver:
+//  Instance of DumpPool.
+//
+// Returns:
+//  Nothing.
+func (p *DumpPool) Submit(msg Message) {
+	p.jobs <- DumpJob{
+		Msg:  msg,
+		Path: GetDumpMsgPath(msg),
+	}
+}
+
+// Close stops accepting messages and waits until every queued Message is written.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of DumpPool.
+//
+// Returns:
+//  Nothing.
+func (p *DumpPool) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// Stats returns how many messages were written and how many failed.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of DumpPool.
+//
+// Returns:
+//  (number of messages written, number of failures)
+func (p *DumpPool) Stats() (int64, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Dumped, p.Failed
+}
+
+// work is the routine of each worker. Failures are logged and counted, but don't stop the worker.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of DumpPool.
+//
+// Returns:
+//  Nothing.
+func (p *DumpPool) work() {
+	defer p.wg.Done()
+
+	for job := range p.jobs {
+		err := WriteMessageFile(job.Msg, job.Path, currentConfig.DumpSyncFiles)
+
+		p.mu.Lock()
+		if err != nil {
+			p.Failed++
+		} else {
+			p.Dumped++
+		}
+		p.mu.Unlock()
+
+		if err != nil {
+			log.Printf("[ERROR] Failed to dump Message '%s' to file '%s'. Details: %s\n",
+				job.Msg.EventId, job.Path, err)
+		}
+	}
+}
+
+// PrintDumpSummary logs how many messages were written to disk and how many failed.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  Nothing.
+func PrintDumpSummary() {
+	if dumpPool == nil {
+		return
+	}
+
+	dumped, failed := dumpPool.Stats()
+	log.Println(fmt.Sprintf("Messages dumped to file: %d (failed: %d)", dumped, failed))
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadEncryptionKey reads an encryption key from a file or from an environment variable. The key may be raw bytes
+// (files only), hex or base64, and must have 16, 24 or 32 bytes (AES-128, AES-192 or AES-256).
+//
+// Parameters:
+//  file: path of the file with the key. empty if the key is in an environment variable.
+//  env: name of the environment variable with the key. empty if the key is in a file.
+//
+// Returns:
+//  the key and error, if it could not be read or is not valid. nil if neither file nor env were set.
+func LoadEncryptionKey(file string, env string) ([]byte, error) {
+	var data []byte
+	switch {
+	case file != "":
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		data = content
+	case env != "":
+		value, found := os.LookupEnv(env)
+		if !found {
+			return nil, fmt.Errorf("environment variable '%s' is not set", env)
+		}
+		data = []byte(value)
+	default:
+		return nil, nil
+	}
+
+	return ParseEncryptionKey(data)
+}
+
+// ParseEncryptionKey decodes an encryption key written as hex, base64 or raw bytes.
+//
+// Parameters:
+//  data: encoded key.
+//
+// Returns:
+//  the key and error, if it doesn't have 16, 24 or 32 bytes.
+func ParseEncryptionKey(data []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && isValidKeySize(key) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && isValidKeySize(key) {
+		return key, nil
+	}
+	if isValidKeySize(data) {
+		return data, nil
+	}
+
+	return nil, errors.New("the key must have 16, 24 or 32 bytes (raw, hex or base64)")
+}
+
+// isValidKeySize checks if a key can be used by AES.
+//
+// Parameters:
+//  key: key that will be checked.
+//
+// Returns:
+//  true if it has 16, 24 or 32 bytes. false otherwise.
+func isValidKeySize(key []byte) bool {
+	return len(key) == 16 || len(key) == 24 || len(key) == 32
+}
+
+// EncryptData encrypts data with AES-GCM. The result starts with the magic bytes 'HTE' and one byte with the version
+// of the format, followed by the nonce and by the sealed data.
+//
+// Parameters:
+//  data: data that will be encrypted.
+//  key: AES key.
+//
+// Returns:
+//  encrypted data and error, if it could not be encrypted.
+func EncryptData(data []byte, key []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(encryptedFileMagic), encryptedFileVersion)
+	encrypted := make([]byte, 0, len(header)+len(nonce)+len(data)+gcm.Overhead())
+	encrypted = append(append(encrypted, header...), nonce...)
+	return gcm.Seal(encrypted, nonce, data, header), nil
+}
+
+// DecryptData decrypts data encrypted by EncryptData.
+//
+// Parameters:
+//  data: encrypted data.
+//  key: AES key used to encrypt it.
+//
+// Returns:
+//  decrypted data and error, if it's not encrypted, it was changed or the key is not the right one.
+func DecryptData(data []byte, key []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize := len(encryptedFileMagic) + 1
+	if len(data) < headerSize+gcm.NonceSize() || !bytes.HasPrefix(data, []byte(encryptedFileMagic)) {
+		return nil, errors.New("data was not encrypted by this tool")
+	}
+	if data[headerSize-1] != encryptedFileVersion {
+		return nil, fmt.Errorf("encryption format %d is not supported", data[headerSize-1])
+	}
+
+	nonce := data[headerSize : headerSize+gcm.NonceSize()]
+	decrypted, err := gcm.Open(nil, nonce, data[headerSize+gcm.NonceSize():], data[:headerSize])
+	if err != nil {
+		return nil, errors.New("wrong key or corrupted data")
+	}
+
+	return decrypted, nil
+}
+
+// NewEncryptedWriter creates an EncryptedWriter. Close must be called after the last write.
+//
+// Parameters:
+//  writer: where the encrypted chunks are written.
+//  key: AES key.
+//
+// Returns:
+//  new instance of EncryptedWriter.
+func NewEncryptedWriter(writer io.Writer, key []byte) *EncryptedWriter {
+	return &EncryptedWriter{
+		writer: writer,
+		key:    key,
+		buffer: make([]byte, 0, encryptedChunkSize),
+	}
+}
+
+// Write buffers data and encrypts it, every time a chunk is full.
+//
+// Parameters:
+//  data: data that will be encrypted.
+//
+// Receiver:
+//  Instance of EncryptedWriter.
+//
+// Returns:
+//  number of bytes of data taken and error, if a chunk could not be encrypted or written.
+func (w *EncryptedWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := copy(w.buffer[len(w.buffer):cap(w.buffer)], data)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		data = data[n:]
+		written += n
+
+		if len(w.buffer) == cap(w.buffer) {
+			if err := w.writeChunk(w.buffer); err != nil {
+				return written, err
+			}
+			w.buffer = w.buffer[:0]
+		}
+	}
+
+	return written, nil
+}
+
+// Close encrypts the data still buffered and writes the empty chunk that ends the data. The underlying writer is not
+// closed.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of EncryptedWriter.
+//
+// Returns:
+//  error if the chunks could not be encrypted or written.
+func (w *EncryptedWriter) Close() error {
+	if len(w.buffer) > 0 {
+		if err := w.writeChunk(w.buffer); err != nil {
+			return err
+		}
+		w.buffer = w.buffer[:0]
+	}
+
+	return w.writeChunk(nil)
+}
+
+// writeChunk encrypts a chunk and writes it, preceded by its size (4 bytes, big endian).
+//
+// Parameters:
+//  chunk: data that will be encrypted. empty for the chunk that ends the data.
+//
+// Receiver:
+//  Instance of EncryptedWriter.
+//
+// Returns:
+//  error if the chunk could not be encrypted or written.
+func (w *EncryptedWriter) writeChunk(chunk []byte) error {
+	var encrypted []byte
+	if len(chunk) > 0 {
+		var err error
+		if encrypted, err = EncryptData(chunk, w.key); err != nil {
+			return err
+		}
+	}
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(encrypted)))
+	if _, err := w.writer.Write(size); err != nil {
+		return err
+	}
+	_, err := w.writer.Write(encrypted)
+	return err
+}
+
+// NewEncryptedReader creates an EncryptedReader.
+//
+// Parameters:
+//  reader: where the encrypted chunks are read from.
+//  key: AES key used to encrypt them.
+//
+// Returns:
+//  new instance of EncryptedReader.
+func NewEncryptedReader(reader io.Reader, key []byte) *EncryptedReader {
+	return &EncryptedReader{
+		reader: reader,
+		key:    key,
+	}
+}
+
+// Read decrypts the next chunks, as needed, and returns their data.
+//
+// Parameters:
+//  data: buffer where the decrypted data is copied.
+//
+// Receiver:
+//  Instance of EncryptedReader.
+//
+// Returns:
+//  number of bytes copied and error, if a chunk could not be read or decrypted. io.EOF after the last chunk.
+func (r *EncryptedReader) Read(data []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(data, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// readChunk reads and decrypts the next chunk.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of EncryptedReader.
+//
+// Returns:
+//  error if the chunk could not be read or decrypted, or if the data ends before the empty chunk.
+func (r *EncryptedReader) readChunk() error {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r.reader, size); err != nil {
+		return getChunkReadError(err)
+	}
+
+	length := binary.BigEndian.Uint32(size)
+	if length == 0 {
+		r.done = true
+		return nil
+	}
+	// Room for the data, the header, the nonce and the authentication tag.
+	if length > encryptedChunkSize+1024 {
+		return errors.New("encrypted data is corrupted")
+	}
+
+	encrypted := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, encrypted); err != nil {
+		return getChunkReadError(err)
+	}
+
+	var err error
+	r.chunk, err = DecryptData(encrypted, r.key)
+	return err
+}
+
+// getChunkReadError translates the error of reading an encrypted chunk.
+//
+// Parameters:
+//  err: error returned while reading the chunk.
+//
+// Returns:
+//  the error. a clearer one if the data ended too soon.
+func getChunkReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("encrypted data is truncated")
+	}
+
+	return err
+}
+
+// newGcm creates an AES-GCM cipher.
+//
+// Parameters:
+//  key: AES key.
+//
+// Returns:
+//  the cipher and error, if the key is not valid.
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// DecryptFiles decrypts every encrypted file ('.enc') in a directory and its subdirectories, or a single file.
+// Decrypted files are written without the '.enc' extension, next to the encrypted ones or, if an output directory
+// is set, in the same relative path inside it. Encrypted files are kept.
+// Will panic in case of failure.
+//
+// Parameters:
+//  path: directory or file that will be decrypted.
+//  outDir: directory where decrypted files are written. empty to write them next to the encrypted ones.
+//
+// Returns:
+//  number of files decrypted.
+func DecryptFiles(path string, outDir string) int {
+	info, err := os.Stat(path)
+	HandleError(fmt.Sprintf("Failed to read '%s'.", path), err, true)
+
+	baseDir := path
+	if !info.IsDir() {
+		baseDir = filepath.Dir(path)
+	}
+
+	decrypted := 0
+	err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(file) != encryptedFileExtension {
+			return nil
+		}
+
+		target := strings.TrimSuffix(file, encryptedFileExtension)
+		if outDir != "" {
+			relative, err := filepath.Rel(baseDir, target)
+			if err != nil {
+				return err
+			}
+			target = filepath.Join(outDir, relative)
+			EnsureDirExists(filepath.Dir(target))
+		}
+
+		data, err := DecryptData(ReadFile(file), encryptionKey)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt '%s': %v", file, err)
+		}
+		if err = ioutil.WriteFile(target, data, 0600); err != nil {
+			return err
+		}
+
+		decrypted++
+		if pBar != nil {
+			_ = pBar.Add(1)
+		}
+		return nil
+	})
+	HandleError("Failed to decrypt files.", err, true)
+
+	return decrypted
+}
+
+// RotateEncryptionKey re-encrypts the data keys of the badger database with a new master key. Data is not rewritten,
+// only the key registry is, so databases created without a key can't be encrypted this way. The database must be
+// closed.
+// Will panic in case of failure.
+//
+// Parameters:
+//  oldKey: current master key.
+//  newKey: new master key.
+//
+// Returns:
+//  Nothing.
+func RotateEncryptionKey(oldKey []byte, newKey []byte) {
+	opts := badger.KeyRegistryOptions{
+		Dir:                           currentConfig.BadgerDir,
+		ReadOnly:                      true,
+		EncryptionKey:                 oldKey,
+		EncryptionKeyRotationDuration: dataKeyRotationDuration,
+	}
+
+	registry, err := badger.OpenKeyRegistry(opts)
+	HandleError("Failed to open the key registry. Is the current key right?", err, true)
+	defer registry.Close()
+
+	opts.EncryptionKey = newKey
+	err = badger.WriteKeyRegistry(registry, opts)
+	HandleError("Failed to write the key registry with the new key.", err, true)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+// TestEncryptData checks that encrypted data is decrypted back with the same key, and only with it, and that
+// changed data is detected.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestEncryptData(t *testing.T) {
+	key := newTestKey(t)
+	data := []byte("message payload")
+
+	encrypted, err := EncryptData(data, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(encrypted, []byte(encryptedFileMagic)) || bytes.Contains(encrypted, data) {
+		t.Fatal("encrypted data should start with the magic bytes and not contain the original data")
+	}
+
+	decrypted, err := DecryptData(encrypted, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Error("decrypted data is different from the original")
+	}
+
+	if _, err = DecryptData(encrypted, newTestKey(t)); err == nil {
+		t.Error("decrypting with another key should fail")
+	}
+
+	encrypted[len(encrypted)-1] ^= 1
+	if _, err = DecryptData(encrypted, key); err == nil {
+		t.Error("decrypting changed data should fail")
+	}
+}
+
+// TestParseEncryptionKey checks that keys are read as hex, base64 or raw bytes, and that keys without 16, 24 or 32
+// bytes are rejected.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestParseEncryptionKey(t *testing.T) {
+	sizes := map[string]int{
+		"000102030405060708090a0b0c0d0e0f":             16,
+		"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=": 32,
+		"0123456789abcdefghijklmn":                     24,
+	}
+	for text, size := range sizes {
+		if key, err := ParseEncryptionKey([]byte(text)); err != nil || len(key) != size {
+			t.Errorf("key '%s' has %d bytes (error: %v), want %d", text, len(key), err, size)
+		}
+	}
+
+	if _, err := ParseEncryptionKey([]byte("too short")); err == nil {
+		t.Error("a key that doesn't have 16, 24 or 32 bytes should be rejected")
+	}
+}
+
+// TestEncryptedWriter writes data bigger than a chunk to an EncryptedWriter, in pieces that don't match the chunks,
+// and checks that an EncryptedReader reads it back, and that it fails when the last chunk is missing.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestEncryptedWriter(t *testing.T) {
+	key := newTestKey(t)
+	data := make([]byte, encryptedChunkSize*2+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var encrypted bytes.Buffer
+	writer := NewEncryptedWriter(&encrypted, key)
+	for _, piece := range [][]byte{data[:10], data[10 : encryptedChunkSize+5], data[encryptedChunkSize+5:]} {
+		if _, err := writer.Write(piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := ioutil.ReadAll(NewEncryptedReader(bytes.NewReader(encrypted.Bytes()), key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Error("decrypted data is different from the data written")
+	}
+
+	truncated := encrypted.Bytes()[:encrypted.Len()-4]
+	if _, err = ioutil.ReadAll(NewEncryptedReader(bytes.NewReader(truncated), key)); err == nil {
+		t.Error("reading data without its last chunk should fail")
+	}
+}
+
+// newTestKey creates a random AES-256 key.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  the key.
+func newTestKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
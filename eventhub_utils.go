@@ -4,52 +4,172 @@ import (
 	"context"
 	"fmt"
 	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
 	"github.com/dgraph-io/badger/v3"
 	"log"
-	"os"
-	"path/filepath"
-	"strings"
 	"time"
 )
 
-// StartReceivingMessages will create an instance of Eventhub Consumer and wait for messages.
+// StartReceivingMessages will create an instance of Eventhub Consumer for each configured source and wait for messages.
 // Will panic in case of failure.
 //
 // Parameters:
-//  connectionString: connection string that will be used to open a connection to Eventhub
-//  entityPath: name of the entity path (eventhub) that will be targeted.
+//  readCtx: context of the read operation. once it's cancelled, received messages are no longer processed.
+//  db: badger database where the checkpoints are stored. nil if messages are not stored (tail).
 //
 // Returns:
-//  Nothing.
-func StartReceivingMessages(connectionString string, entityPath string) {
-	var err error
-	ctx, hub := GetEventHubClient(connectionString, entityPath)
+//  eventhub clients with the receivers. they must be closed to stop receiving.
+func StartReceivingMessages(readCtx context.Context, db *badger.DB) []HubClient {
 
-	_, err = hub.Receive(ctx, "0", OnMsgReceived, eventhub.ReceiveWithConsumerGroup(currentConfig.ConsumerGroup))
-	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
+	var hubs []HubClient
+	for _, source := range currentConfig.Sources {
+		hubs = append(hubs, StartReceivingFromSource(readCtx, db, source))
 	}
+
+	for _, balancer := range leaseBalancers {
+		go balancer.Run(readCtx)
+	}
+
+	readStats.CheckCaughtUp()
+	return hubs
 }
 
-// GetEventHubClient instantiate an Eventhub.
+// StartReceivingFromSource will create an instance of Eventhub Consumer for a source.
+// One receiver is opened for each partition that should be read, and every one of them starts at the configured
+// start position. When partitions are load balanced, receivers are only opened for the partitions whose lease is
+// acquired by this instance, once the balancer of the source runs.
 // Will panic in case of failure.
 //
 // Parameters:
-//  connectionString: connection string that will be used to open a connection to Eventhub
-//  entityPath: name of the entity path (eventhub) that will be targeted.
+//  readCtx: context of the read operation. once it's cancelled, received messages are no longer processed.
+//  db: badger database where the checkpoints are stored. nil if messages are not stored.
+//  source: eventhub that will be read.
 //
 // Returns:
-//  context and eventhub client.
-func GetEventHubClient(connectionString string, entityPath string) (context.Context, *eventhub.Hub) {
-	ctx := context.Background()
+//  eventhub client with the receivers. it must be closed to stop receiving.
+func StartReceivingFromSource(readCtx context.Context, db *badger.DB, source SourceConfig) HubClient {
+	ctx, hub, info := GetEventHubClient(source.EventhubConnectionString, source.EntityPath)
+	partitions := GetPartitionsToRead(source, info.PartitionIDs)
+
+	if currentConfig.UntilCaughtUp {
+		WatchPartitionsUntilCaughtUp(ctx, hub, db, source, partitions)
+	}
+
+	if currentConfig.LoadBalancing.Enabled {
+		leaseBalancers[source.Name] = NewPartitionBalancer(source.Name, NewLeaseStore(source), partitions,
+			func(partitionCtx context.Context, partitionId string) error {
+				opts := GetStartPositionOptions(db, source, partitionId)
+				opts.ConsumerGroup = source.ConsumerGroup
+				return hub.Receive(partitionCtx, partitionId,
+					GetMsgReceivedHandler(partitionCtx, source.Name, partitionId), opts)
+			})
+
+		log.Printf("Balancing %d partition(s) of '%s' with other instances as '%s': %s\n",
+			len(partitions), source.Name, currentConfig.LoadBalancing.InstanceName, partitions)
+		return hub
+	}
+
+	for _, partitionId := range partitions {
+		opts := GetStartPositionOptions(db, source, partitionId)
+		opts.ConsumerGroup = source.ConsumerGroup
+
+		err := hub.Receive(ctx, partitionId, GetMsgReceivedHandler(readCtx, source.Name, partitionId), opts)
+		HandleError(fmt.Sprintf("Failed to start receiving messages from partition '%s' of '%s'",
+			partitionId, source.Name), err, true)
+	}
+
+	log.Printf("Receiving messages from %d partition(s) of '%s': %s\n", len(partitions), source.Name, partitions)
+	return hub
+}
+
+// GetStartPositionOptions returns the receive options that make a receiver start at the configured position.
+// When the start position is 'checkpoint', the last checkpoint saved for the partition is used (if any).
+// Eventhub can't start reading from a sequence number, so in this case the partition is read from the start and
+// older messages are skipped by OnMsgReceived.
+// When partitions are load balanced, the checkpoint saved in the lease store is used first, whatever the start
+// position is, since the partition was already being read by another instance.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database where the checkpoints are stored.
+//  source: eventhub the receiver will read.
+//  partitionId: id of the partition the receiver will read.
+//
+// Returns:
+//  receive options with the start position. Empty if eventhub defaults should be used.
+func GetStartPositionOptions(db *badger.DB, source SourceConfig, partitionId string) ReceiveOptions {
+	if balancer, found := leaseBalancers[source.Name]; found {
+		if checkpoint := balancer.LoadCheckpoint(partitionId); checkpoint != nil {
+			log.Printf("Resuming partition '%s' of '%s' after offset '%s' (sequence number: %d), from lease store.\n",
+				partitionId, source.Name, checkpoint.Offset, checkpoint.SequenceNumber)
+			return ReceiveOptions{StartOffset: checkpoint.Offset}
+		}
+	}
 
-	if !strings.Contains(connectionString, ";EntityPath=") {
-		connectionString = fmt.Sprintf("%s;EntityPath=%s", connectionString, entityPath)
+	switch currentConfig.StartPosition {
+	case startPositionEarliest, startPositionSequenceNumber:
+		return ReceiveOptions{StartOffset: persist.StartOfStream}
+
+	case startPositionLatest:
+		return ReceiveOptions{StartOffset: persist.EndOfStream}
+
+	case startPositionEnqueuedTime:
+		return ReceiveOptions{StartTime: currentConfig.StartEnqueuedTime}
+	}
+
+	if db == nil {
+		return ReceiveOptions{}
+	}
+
+	checkpoint := LoadCheckpoint(db, source, partitionId)
+	if checkpoint == nil {
+		return ReceiveOptions{}
+	}
+
+	log.Printf("Resuming partition '%s' of '%s' after offset '%s' (sequence number: %d).\n",
+		partitionId, source.Name, checkpoint.Offset, checkpoint.SequenceNumber)
+	return ReceiveOptions{StartOffset: checkpoint.Offset}
+}
+
+// GetPartitionsToRead returns the partitions of a source that must be read, based on the configuration.
+// If no partition was configured, all available partitions will be read.
+// Will panic if a configured partition is not available in the eventhub.
+//
+// Parameters:
+//  source: eventhub that will be read.
+//  available: partition ids reported by the eventhub runtime information.
+//
+// Returns:
+//  list of partition ids that will be read.
+func GetPartitionsToRead(source SourceConfig, available []string) []string {
+	if len(source.Partitions) == 0 {
+		return available
 	}
 
-	hub, err := eventhub.NewHubFromConnectionString(connectionString)
-	HandleError("Failed to create new EventHub client from connection string", err, true)
+	for _, partitionId := range source.Partitions {
+		if !Contains(available, partitionId) {
+			HandleError("Invalid partition configuration",
+				fmt.Errorf("partition '%s' does not exist in '%s'. available partitions: %s",
+					partitionId, source.Name, available),
+				true)
+		}
+	}
+
+	return source.Partitions
+}
+
+// GetEventHubClient instantiate an Eventhub client, using the configured transport.
+// Will panic in case of failure.
+//
+// Parameters:
+//  connectionString: connection string that will be used to open a connection to Eventhub
+//  entityPath: name of the entity path (eventhub) that will be targeted.
+//
+// Returns:
+//  context, eventhub client and the runtime information of the eventhub.
+func GetEventHubClient(connectionString string, entityPath string) (context.Context, HubClient, *eventhub.HubRuntimeInformation) {
+	ctx := context.Background()
+	hub := NewHubClient(connectionString, entityPath)
 
 	info, e := hub.GetRuntimeInformation(ctx)
 	HandleError("Failed to get runtime information", e, true)
@@ -57,77 +177,179 @@ func GetEventHubClient(connectionString string, entityPath string) (context.Cont
 	log.Printf("Runtime started at '%s', pointing at path '%s' with %d partitions. Available partitions: %s\n",
 		info.CreatedAt, info.Path, info.PartitionCount, info.PartitionIDs)
 
-	return ctx, hub
+	return ctx, hub, info
+}
+
+// CloseEventHubClient closes the eventhub client, including every receiver and sender it opened.
+// Will panic in case of failure.
+//
+// Parameters:
+//  hub: eventhub client that will be closed.
+//
+// Returns:
+//  Nothing.
+func CloseEventHubClient(hub HubClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), gracefulShutdownTimeout)
+	defer cancel()
+
+	err := hub.Close(ctx)
+	HandleError("Failed to close eventhub client.", err, true)
+}
+
+// GetMsgReceivedHandler creates the handler for messages received on a specific partition.
+// The source and the partition id are not informed by eventhub in the event, so they're bound to the handler.
+//
+// Parameters:
+//  readCtx: context of the read operation.
+//  source: name of the source the handler will receive messages from.
+//  partitionId: id of the partition the handler will receive messages from.
+//
+// Returns:
+//  handler that will be passed to the eventhub receiver.
+func GetMsgReceivedHandler(readCtx context.Context, source string, partitionId string) eventhub.Handler {
+	return func(_ context.Context, event *eventhub.Event) error {
+		return OnMsgReceived(readCtx, source, partitionId, event)
+	}
 }
 
 // OnMsgReceived is the handler for received messages on eventhub.
+// Once the read operation is cancelled, received messages are dropped. They were not checkpointed, so they'll be
+// received again next time.
 //
 // Parameters:
-//  _: Context. Passed automatically by the eventhub client. Not used, but can't get rid of it.
+//  readCtx: context of the read operation.
+//  source: name of the source the event was received from.
+//  partitionId: id of the partition the event was received from.
 //  event: pointer to the event containing all the data we need.
 //
 // Returns:
 //  Nothing
-func OnMsgReceived(_ context.Context, event *eventhub.Event) error {
+func OnMsgReceived(readCtx context.Context, source string, partitionId string, event *eventhub.Event) error {
+	if currentConfig.StartPosition == startPositionSequenceNumber &&
+		*event.SystemProperties.SequenceNumber < currentConfig.StartSequenceNumber {
+		return nil
+	}
+
 	checkpoint := Message{
-		EventId:        event.ID,
-		QueuedTime:     *event.SystemProperties.EnqueuedTime,
-		EventSeqNumber: event.SystemProperties.SequenceNumber,
-		EventOffset:    event.SystemProperties.Offset,
-		ProcessedAt:    time.Now(),
-		MsgData:        string(event.Data),
-		DumpFilename:   GetDumpMsgFilename(event.ID),
+		EventId:          event.ID,
+		QueuedTime:       *event.SystemProperties.EnqueuedTime,
+		EventSeqNumber:   event.SystemProperties.SequenceNumber,
+		EventOffset:      event.SystemProperties.Offset,
+		PartitionId:      partitionId,
+		PartitionKey:     GetEventPartitionKey(event),
+		Properties:       StringifyProperties(event.Properties),
+		SystemProperties: StringifyProperties(event.SystemProperties.Annotations),
+		ProcessedAt:      time.Now(),
+		Body:             event.Data,
+		ContentType:      GetContentType(event.Properties, event.Data),
+		Source:           source,
 	}
+	ValidateMessage(&checkpoint)
+	checkpoint.Key = GetMessageKey(checkpoint)
+	checkpoint.DumpFilename = GetDumpMsgFilename(GetDumpMsgId(checkpoint))
 
-	_ = pBar.Add(1)
+	select {
+	case messageChannel <- checkpoint:
+		if pBar != nil {
+			_ = pBar.Add(1)
+		}
+	case <-readCtx.Done():
+	}
 
-	messageChannel <- checkpoint
 	return nil
 }
 
+// GetEventPartitionKey returns the partition key used when the event was sent.
+//
+// Parameters:
+//  event: pointer to the received event.
+//
+// Returns:
+//  partition key of the event. Empty if none was used.
+func GetEventPartitionKey(event *eventhub.Event) string {
+	if event.PartitionKey != nil {
+		return *event.PartitionKey
+	}
+
+	if event.SystemProperties.PartitionKey != nil {
+		return *event.SystemProperties.PartitionKey
+	}
+
+	return ""
+}
+
 // ProcessMessage is a routine to process received messages.
+// Messages are saved to the database in batches, flushed when the batch is full or periodically.
+// When the read operation is cancelled, every message already received is saved before returning.
+// If the database connection is closed, messages not saved yet are lost, and how many is logged.
 // Will panic in case of failure.
 //
 // Parameters:
-//  None
+//  readCtx: context of the read operation.
+//  done: channel that will be closed when this routine returns.
 //
 // Returns:
 //  Nothing.
-func ProcessMessage() {
+func ProcessMessage(readCtx context.Context, done chan<- struct{}) {
+	defer close(done)
 	db := OpenConnection()
+	writer := NewMessageWriter(db, currentConfig.BatchSize, LoadDedupFilter(db))
+	writer.OnWritten = readStats.Track
 
-	for {
-		msg, channelOpen := <-messageChannel
-		if !channelOpen {
-			break
-		}
-
-		if !StillHaveConnection(db) {
-			log.Println("Connection closed. Cancelling read operation...")
-			return
-		}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
 
-		dbErr := db.Update(func(txn *badger.Txn) error {
+	for {
+		select {
+		case msg := <-messageChannel:
 			if !StillHaveConnection(db) {
-				return nil
+				// The database is closed, so neither this message nor the pending ones can be saved anymore.
+				log.Printf("Connection closed. Cancelling read operation... (%d received messages were not saved)\n",
+					writer.Pending()+1)
+				return
 			}
-			if _, err := txn.Get([]byte(msg.EventId)); err == badger.ErrKeyNotFound {
-				if !StillHaveConnection(db) {
-					return nil
-				}
 
-				msg.ElapsedTime = fmt.Sprintf("%s", time.Since(msg.ProcessedAt))
-				if currentConfig.ReadToFile {
-					DumpMessage(msg, filepath.Join(GetDataDumpDirBasedOnTime(msg.ProcessedAt), msg.DumpFilename))
-				}
+			writer.Add(msg)
+			if readStats.IsMaxMessagesPending(writer.Pending()) {
+				writer.Flush()
+			}
 
-				err = txn.Set([]byte(msg.EventId), msg.Serialize())
+		case <-ticker.C:
+			writer.Flush()
 
-				return err
+		case <-readCtx.Done():
+			drainMessageChannel(writer)
+			return
+		}
+
+		if readStats.IsStopped() {
+			writer.Flush()
+			return
+		}
+	}
+}
+
+// drainMessageChannel saves every message waiting in the message channel, without waiting for new ones.
+// Will panic in case of failure.
+//
+// Parameters:
+//  writer: writer used to save the messages.
+//
+// Returns:
+//  Nothing.
+func drainMessageChannel(writer *MessageWriter) {
+	for {
+		select {
+		case msg := <-messageChannel:
+			if readStats.IsMaxMessagesPending(writer.Pending()) {
+				writer.Flush()
+				return
 			}
-			return nil
-		})
+			writer.Add(msg)
 
-		HandleError("Failed to process received Message.", dbErr, true)
+		default:
+			writer.Flush()
+			return
+		}
 	}
 }
@@ -2,49 +2,55 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
-// DumpMessage creates a text file with the Message received.
-// Will panic in case of failure.
+// WriteMessageFile creates a file with the Message received.
+// When only the message data is dumped, the payload is written as-is (binary payloads included), except for protobuf
+// payloads, that are written decoded to JSON. With 'encryption.encryptFiles', the file is encrypted (see EncryptData).
 //
 // Parameters:
 //  checkpoint: Message with data extracted from the eventhub event.
 //  path: path where this checkpoint will be saved.
+//  sync: if true, the file will be flushed to disk before returning.
 //
 // Returns:
-//  Nothing.
-func DumpMessage(checkpoint Message, path string) {
+//  error if the file could not be written.
+func WriteMessageFile(checkpoint Message, path string, sync bool) error {
 	file, err := os.Create(path)
 	if err != nil {
-		HandleError(fmt.Sprintf("Failed to create file '%s'.", path), err, true)
+		return err
+	}
+
+	var content []byte
+	if currentConfig.DumpOnlyMessageData {
+		content = checkpoint.GetDisplayBody()
 	} else {
-		defer func() {
-			if err := file.Close(); err != nil {
-				HandleError(fmt.Sprintf("Failed to close file '%s'.", path), err, true)
-			}
-		}()
-		var content string
-		if currentConfig.DumpOnlyMessageData {
-			content = checkpoint.MsgData
-		} else {
-			content = checkpoint.ToString()
+		content = []byte(checkpoint.ToString())
+	}
+
+	if currentConfig.Encryption.EncryptFiles {
+		if content, err = EncryptData(content, encryptionKey); err != nil {
+			_ = file.Close()
+			return err
 		}
+	}
 
-		_, err = io.WriteString(file, content)
-		if err != nil {
-			HandleError(fmt.Sprintf("Failed to write to file '%s'.", path), err, true)
-		} else {
-			defer func() {
-				if err := file.Sync(); err != nil {
-					HandleError(fmt.Sprintf("Failed to flush file '%s' to disk.", path), err, true)
-				}
-			}()
+	if _, err = file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if sync {
+		if err = file.Sync(); err != nil {
+			_ = file.Close()
+			return err
 		}
 	}
+
+	return file.Close()
 }
 
 // EnsureDirExists if the path does not exist, tries to create it.
@@ -95,18 +101,18 @@ func MoveFile(old string, new string) {
 	HandleError(fmt.Sprintf("Failed to move file '%s' to '%s'", old, new), err, true)
 }
 
-// ReadTextFile will read a text file and return it's content. If something goes wrong, will explode.
+// ReadFile will read a file and return it's content, byte by byte. If something goes wrong, will explode.
 // Will panic read fails.
 //
 // Parameters:
 //  f: path to the file that will be read.
 //
 // Returns:
-//  String content of the file.
-func ReadTextFile(f string) string {
+//  Raw content of the file.
+func ReadFile(f string) []byte {
 	content, err := ioutil.ReadFile(f)
 	HandleError(fmt.Sprintf("Failed to read file '%s'", f), err, true)
-	return string(content)
+	return content
 }
 
 // ListFiles will return two things: the list of the files found in the directory and the number of files found.
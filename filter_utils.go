@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseFilter parses a filter expression: one or more conditions joined by '&&'. A '&&' inside a quoted value is part
+// of the value. Each condition is written as '<field> <operator> <value>', or '<field> exists'.
+// Supported fields: id, source, partition, partitionKey, contentType, enqueuedTime, validation, body, body.<json path>,
+// prop.<application property> and sys.<system property>.
+//
+// Parameters:
+//  expr: filter expression.
+//
+// Returns:
+//  parsed filter (nil if the expression is empty) and error, if the expression is not valid.
+func ParseFilter(expr string) (*MessageFilter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+
+	filter := &MessageFilter{}
+	for _, part := range SplitFilterConditions(expr) {
+		condition, err := ParseFilterCondition(part)
+		if err != nil {
+			return nil, err
+		}
+		filter.Conditions = append(filter.Conditions, condition)
+	}
+
+	return filter, nil
+}
+
+// SplitFilterConditions splits a filter expression in its conditions, at every '&&' that is not inside a quoted
+// value. Values are quoted as Go strings: with double quotes, where '\"' is a quote, or with backquotes.
+//
+// Parameters:
+//  expr: filter expression.
+//
+// Returns:
+//  conditions of the expression.
+func SplitFilterConditions(expr string) []string {
+	var conditions []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case quote == '"' && expr[i] == '\\':
+			i++
+		case quote != 0:
+			if expr[i] == quote {
+				quote = 0
+			}
+		case expr[i] == '"' || expr[i] == '`':
+			quote = expr[i]
+		case strings.HasPrefix(expr[i:], "&&"):
+			conditions = append(conditions, expr[start:i])
+			start = i + 2
+			i++
+		}
+	}
+
+	return append(conditions, expr[start:])
+}
+
+// ParseFilterCondition parses a single condition of a filter expression.
+//
+// Parameters:
+//  expr: condition, like: prop.eventType == "order-created"
+//
+// Returns:
+//  parsed condition and error, if the condition is not valid.
+func ParseFilterCondition(expr string) (FilterCondition, error) {
+	fields := strings.Fields(expr)
+	if len(fields) < 2 {
+		return FilterCondition{}, fmt.Errorf("filter condition '%s' is incomplete", strings.TrimSpace(expr))
+	}
+
+	condition := FilterCondition{Field: fields[0], Operator: fields[1]}
+	if condition.Operator == filterOperatorExists {
+		if len(fields) > 2 {
+			return FilterCondition{}, fmt.Errorf("filter condition '%s' must not have a value", strings.TrimSpace(expr))
+		}
+		return condition, nil
+	}
+
+	switch condition.Operator {
+	case filterOperatorEqual, filterOperatorNotEqual, filterOperatorGreater, filterOperatorGreaterEqual,
+		filterOperatorLess, filterOperatorLessEqual, filterOperatorContains:
+		break
+	default:
+		return FilterCondition{}, fmt.Errorf("operator '%s' is not supported", condition.Operator)
+	}
+
+	if len(fields) < 3 {
+		return FilterCondition{}, fmt.Errorf("filter condition '%s' has no value", strings.TrimSpace(expr))
+	}
+
+	value := strings.TrimSpace(expr)
+	value = strings.TrimSpace(value[len(condition.Field):])
+	value = strings.TrimSpace(value[len(condition.Operator):])
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+	condition.Value = value
+
+	if condition.Field == "enqueuedTime" {
+		if _, err := time.Parse(time.RFC3339, condition.Value); err != nil {
+			return FilterCondition{}, fmt.Errorf("value '%s' is not a valid RFC3339 timestamp", condition.Value)
+		}
+	}
+
+	return condition, nil
+}
+
+// Matches checks if a Message matches every condition of the filter.
+// A nil filter matches everything.
+//
+// Parameters:
+//  msg: Message that will be checked.
+//
+// Receiver:
+//  Instance of MessageFilter.
+//
+// Returns:
+//  true if the Message matches. false otherwise.
+func (f *MessageFilter) Matches(msg Message) bool {
+	if f == nil {
+		return true
+	}
+
+	var body interface{}
+	bodyParsed := false
+
+	for _, condition := range f.Conditions {
+		if strings.HasPrefix(condition.Field, "body.") && !bodyParsed {
+			body = ParseJsonBody(msg)
+			bodyParsed = true
+		}
+
+		value, found := GetFilterFieldValue(msg, condition.Field, body)
+		if !condition.Matches(value, found) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Matches checks if the value of a field satisfies the condition.
+//
+// Parameters:
+//  value: value of the field in the Message.
+//  found: false if the Message does not have the field.
+//
+// Receiver:
+//  Instance of FilterCondition.
+//
+// Returns:
+//  true if the condition is satisfied. false otherwise.
+func (c FilterCondition) Matches(value string, found bool) bool {
+	switch c.Operator {
+	case filterOperatorExists:
+		return found
+	case filterOperatorNotEqual:
+		return !found || value != c.Value
+	}
+
+	if !found {
+		return false
+	}
+
+	switch c.Operator {
+	case filterOperatorEqual:
+		return value == c.Value
+	case filterOperatorContains:
+		return strings.Contains(value, c.Value)
+	}
+
+	cmp := CompareFilterValues(c.Field, value, c.Value)
+	switch c.Operator {
+	case filterOperatorGreater:
+		return cmp > 0
+	case filterOperatorGreaterEqual:
+		return cmp >= 0
+	case filterOperatorLess:
+		return cmp < 0
+	case filterOperatorLessEqual:
+		return cmp <= 0
+	}
+
+	return false
+}
+
+// CompareFilterValues compares two values of a field. Timestamps and numbers are compared by value, anything
+// else is compared as text.
+//
+// Parameters:
+//  field: name of the field being compared.
+//  a: first value.
+//  b: second value.
+//
+// Returns:
+//  -1 if a < b, 0 if they're equal and 1 if a > b.
+func CompareFilterValues(field string, a string, b string) int {
+	if field == "enqueuedTime" {
+		ta, errA := time.Parse(time.RFC3339Nano, a)
+		tb, errB := time.Parse(time.RFC3339Nano, b)
+		if errA == nil && errB == nil {
+			switch {
+			case ta.Before(tb):
+				return -1
+			case ta.After(tb):
+				return 1
+			}
+			return 0
+		}
+	}
+
+	na, errA := strconv.ParseFloat(a, 64)
+	nb, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(a, b)
+}
+
+// GetFilterFieldValue returns the value of a field of a Message, as text.
+//
+// Parameters:
+//  msg: Message that has the field.
+//  field: name of the field.
+//  body: payload of the Message, parsed as JSON. only used for body.<json path> fields.
+//
+// Returns:
+//  value of the field and false, if the Message does not have the field.
+func GetFilterFieldValue(msg Message, field string, body interface{}) (string, bool) {
+	switch field {
+	case "id":
+		return msg.EventId, true
+	case "source":
+		return msg.Source, true
+	case "partition":
+		return msg.PartitionId, true
+	case "partitionKey":
+		return msg.PartitionKey, msg.PartitionKey != ""
+	case "contentType":
+		return msg.ContentType, true
+	case "enqueuedTime":
+		return msg.QueuedTime.Format(time.RFC3339Nano), true
+	case "validation":
+		return msg.ValidationStatus, msg.ValidationStatus != ""
+	case "body":
+		return msg.BodyToString(), true
+	}
+
+	if strings.HasPrefix(field, "prop.") {
+		value, found := msg.Properties[strings.TrimPrefix(field, "prop.")]
+		return value, found
+	}
+
+	if strings.HasPrefix(field, "sys.") {
+		value, found := msg.SystemProperties[strings.TrimPrefix(field, "sys.")]
+		return value, found
+	}
+
+	if strings.HasPrefix(field, "body.") {
+		return GetJsonPathValue(body, strings.TrimPrefix(field, "body."))
+	}
+
+	return "", false
+}
+
+// ParseJsonBody parses the payload of a Message as JSON (protobuf payloads are decoded first). Numbers are kept as
+// they were written.
+//
+// Parameters:
+//  msg: Message with the payload.
+//
+// Returns:
+//  parsed payload. nil if it's not valid JSON.
+func ParseJsonBody(msg Message) interface{} {
+	var body interface{}
+	decoder := json.NewDecoder(bytes.NewReader(msg.GetDisplayBody()))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil
+	}
+
+	return body
+}
+
+// GetJsonPathValue navigates a parsed JSON document and returns the value found, as text.
+// The path is dot-separated and array items are accessed by index. e.g.: items.0.sku
+//
+// Parameters:
+//  doc: parsed JSON document.
+//  path: path of the value.
+//
+// Returns:
+//  value found and false, if the path does not exist.
+func GetJsonPathValue(doc interface{}, path string) (string, bool) {
+	current := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, found := node[key]
+			if !found {
+				return "", false
+			}
+			current = value
+
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", false
+			}
+			current = node[index]
+
+		default:
+			return "", false
+		}
+	}
+
+	switch value := current.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case nil:
+		return "null", true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+
+	encoded, err := json.Marshal(current)
+	if err != nil {
+		return "", false
+	}
+	return string(encoded), true
+}
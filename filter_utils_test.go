@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+// TestParseFilter checks the conditions parsed from a filter expression, including a '&&' inside a quoted value.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestParseFilter(t *testing.T) {
+	checkFilter(t, `body.tenant != acme && partition >= 3`,
+		FilterCondition{Field: "body.tenant", Operator: filterOperatorNotEqual, Value: "acme"},
+		FilterCondition{Field: "partition", Operator: filterOperatorGreaterEqual, Value: "3"})
+	checkFilter(t, `body.text == "a && b" && prop.region exists`,
+		FilterCondition{Field: "body.text", Operator: filterOperatorEqual, Value: "a && b"},
+		FilterCondition{Field: "prop.region", Operator: filterOperatorExists})
+	checkFilter(t, `body.text contains "say \"a && b\"" && id == x`,
+		FilterCondition{Field: "body.text", Operator: filterOperatorContains, Value: `say "a && b"`},
+		FilterCondition{Field: "id", Operator: filterOperatorEqual, Value: "x"})
+	checkFilter(t, "body.text == `a && b`",
+		FilterCondition{Field: "body.text", Operator: filterOperatorEqual, Value: "a && b"})
+
+	if filter, err := ParseFilter(" "); filter != nil || err != nil {
+		t.Error("an empty expression should not be a filter")
+	}
+	for _, expr := range []string{"prop.eventType ==", "prop.eventType ~= order", "partition == 3 && "} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("expression '%s' should be rejected", expr)
+		}
+	}
+}
+
+// TestFilterMatches checks which messages match a filter with a '&&' inside a quoted value.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestFilterMatches(t *testing.T) {
+	filter, err := ParseFilter(`body.text == "a && b" && prop.eventType == order`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := Message{Properties: map[string]string{"eventType": "order"}, Body: []byte(`{"text":"a && b"}`)}
+	if !filter.Matches(msg) {
+		t.Error("message with every value should match")
+	}
+	msg.Body = []byte(`{"text":"a"}`)
+	if filter.Matches(msg) {
+		t.Error("message with another body should not match")
+	}
+}
+
+// checkFilter fails the test if a filter expression is not parsed to the conditions expected.
+//
+// Parameters:
+//  t: state of the test.
+//  expr: filter expression.
+//  want: expected conditions.
+//
+// Returns:
+//  Nothing.
+func checkFilter(t *testing.T, expr string, want ...FilterCondition) {
+	filter, err := ParseFilter(expr)
+	if err != nil {
+		t.Errorf("expression '%s' was rejected: %v", expr, err)
+		return
+	}
+
+	if len(filter.Conditions) != len(want) {
+		t.Errorf("expression '%s' has %d conditions, want %d", expr, len(filter.Conditions), len(want))
+		return
+	}
+	for i, condition := range filter.Conditions {
+		if condition != want[i] {
+			t.Errorf("condition %d of '%s' is %+v, want %+v", i, expr, condition, want[i])
+		}
+	}
+}
@@ -1,41 +1,498 @@
 package main
 
 import (
+	"context"
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
 	"github.com/dgraph-io/badger/v3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/schollz/progressbar/v3"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"io"
+	"os"
+	"sync"
 	"time"
 )
 
 // Message is the representation of metadata for a received azure eventhub Message.
+// It's saved to badgerDb as JSON (see Serialize), so the field names are part of the storage format.
 type Message struct {
-	EventId        string
-	QueuedTime     time.Time
-	EventSeqNumber *int64
-	EventOffset    *int64
-	DumpFilename   string
-	ProcessedAt    time.Time
-	ElapsedTime    string
-	MsgData        string
+	EventId          string            `json:"eventId"`
+	QueuedTime       time.Time         `json:"enqueuedTime"`
+	EventSeqNumber   *int64            `json:"sequenceNumber"`
+	EventOffset      *int64            `json:"offset"`
+	PartitionId      string            `json:"partitionId"`
+	PartitionKey     string            `json:"partitionKey"`
+	Properties       map[string]string `json:"properties"`
+	SystemProperties map[string]string `json:"systemProperties"`
+	DumpFilename     string            `json:"dumpFilename"`
+	ProcessedAt      time.Time         `json:"processedAt"`
+	ElapsedTime      string            `json:"elapsedTime"`
+	MsgData          string            `json:"msgData,omitempty"`
+	Body             []byte            `json:"body,omitempty"`
+	ContentType      string            `json:"contentType"`
+	Key              string            `json:"key"`
+	Source           string            `json:"source"`
+	ValidationStatus string            `json:"validationStatus,omitempty"`
+	BodyCompression  string            `json:"bodyCompression,omitempty"`
+	uncompressedBody *uncompressedBody
+}
+
+// FakeEvent is an event created by the benchmark, with the partition it's received from.
+type FakeEvent struct {
+	PartitionId string
+	Event       *eventhub.Event
+}
+
+// uncompressedBody is the payload of a Message after being decompressed, kept so it's only decompressed once.
+type uncompressedBody struct {
+	data     []byte
+	encoding string
 }
 
 // Config is the configuration read from the file passed via command line argument.
 type Config struct {
-	MessageDumpDir             string `json:"messageDumpDir"`
-	BadgerBase                 string `json:"badgerBase"`
-	BadgerDir                  string `json:"badgerDir"`
-	BadgerValueDir             string `json:"badgerValueDir"`
-	BadgerValueLogFileSize     int64  `json:"badgerValueLogFileSize"`
-	BadgerSkipCompactL0OnClose bool   `json:"badgerSkipCompactL0OnClose"`
-	BadgerVerbose              bool   `json:"badgerVerbose"`
-	EventhubConnectionString   string `json:"eventhubConnString"`
-	EntityPath                 string `json:"entityPath"`
-	ReadToFile                 bool   `json:"readToFile"`
-	ConsumerGroup              string `json:"consumerGroup"`
-	DumpOnlyMessageData        bool   `json:"dumpOnlyMessageData"`
-	Env                        string `json:"env"`
-	OutboundFolder             string `json:"outboundFolder"`
-	OutboundFolderSent         string `json:"outboundFolderSent"`
-	DontMoveSentFiles          bool   `json:"dontMoveSentFiles"`
+	MessageDumpDir             string                 `json:"messageDumpDir"`
+	BadgerBase                 string                 `json:"badgerBase"`
+	BadgerDir                  string                 `json:"badgerDir"`
+	BadgerValueDir             string                 `json:"badgerValueDir"`
+	BadgerValueLogFileSize     int64                  `json:"badgerValueLogFileSize"`
+	BadgerSkipCompactL0OnClose bool                   `json:"badgerSkipCompactL0OnClose"`
+	BadgerVerbose              bool                   `json:"badgerVerbose"`
+	BadgerCompression          string                 `json:"badgerCompression"`
+	BadgerZstdLevel            int                    `json:"badgerZstdLevel"`
+	StorageCompression         string                 `json:"storageCompression"`
+	EventhubConnectionString   string                 `json:"eventhubConnString"`
+	EntityPath                 string                 `json:"entityPath"`
+	ReadToFile                 bool                   `json:"readToFile"`
+	ConsumerGroup              string                 `json:"consumerGroup"`
+	DumpOnlyMessageData        bool                   `json:"dumpOnlyMessageData"`
+	Env                        string                 `json:"env"`
+	OutboundFolder             string                 `json:"outboundFolder"`
+	OutboundFolderSent         string                 `json:"outboundFolderSent"`
+	DontMoveSentFiles          bool                   `json:"dontMoveSentFiles"`
+	OutboundContentType        string                 `json:"outboundContentType"`
+	OutboundContentEncoding    string                 `json:"outboundContentEncoding"`
+	Partitions                 []string               `json:"partitions"`
+	StartPosition              string                 `json:"startPosition"`
+	StartEnqueuedTime          time.Time              `json:"startEnqueuedTime"`
+	StartSequenceNumber        int64                  `json:"startSequenceNumber"`
+	MaxMessages                int64                  `json:"maxMessages"`
+	MaxDuration                string                 `json:"maxDuration"`
+	UntilCaughtUp              bool                   `json:"untilCaughtUp"`
+	BatchSize                  int                    `json:"batchSize"`
+	BatchFlushInterval         string                 `json:"batchFlushInterval"`
+	DedupFilterCapacity        int                    `json:"dedupFilterCapacity"`
+	DisableDedupFilter         bool                   `json:"disableDedupFilter"`
+	BenchmarkMessages          int                    `json:"benchmarkMessages"`
+	DumpWorkers                int                    `json:"dumpWorkers"`
+	DumpQueueSize              int                    `json:"dumpQueueSize"`
+	DumpSyncFiles              bool                   `json:"dumpSyncFiles"`
+	ShutdownTimeout            string                 `json:"shutdownTimeout"`
+	Transport                  string                 `json:"transport"`
+	MemoryHub                  MemoryHubConfig        `json:"memoryHub"`
+	Filter                     string                 `json:"filter"`
+	DedupKey                   string                 `json:"dedupKey"`
+	DedupKeyProperty           string                 `json:"dedupKeyProperty"`
+	LoadBalancing              LoadBalancingConfig    `json:"loadBalancing"`
+	Sources                    []SourceConfig         `json:"sources"`
+	TailFormat                 string                 `json:"tailFormat"`
+	TailPrettyJson             bool                   `json:"tailPrettyJson"`
+	TailColor                  bool                   `json:"tailColor"`
+	CaptureDir                 string                 `json:"captureDir"`
+	CapturePartition           string                 `json:"capturePartition"`
+	SchemaValidation           SchemaValidationConfig `json:"schemaValidation"`
+	ValidationReport           string                 `json:"validationReport"`
+	Protobuf                   ProtobufConfig         `json:"protobuf"`
+	IndexProperty              string                 `json:"indexProperty"`
+	Export                     ExportConfig           `json:"export"`
+	Retention                  RetentionConfig        `json:"retention"`
+	Encryption                 EncryptionConfig       `json:"encryption"`
+	Backup                     BackupConfig           `json:"backup"`
+}
+
+// BackupConfig is the file written by backup and read by restore. Only entries saved with SinceVersion or a later
+// version are backed up: 0 for a full backup, or the 'nextSinceVersion' of the manifest of the previous backup for an
+// incremental one.
+type BackupConfig struct {
+	File         string `json:"file"`
+	SinceVersion uint64 `json:"sinceVersion"`
+}
+
+// BackupManifest describes a backup file. It's saved next to it, as JSON. The backup has the entries saved with
+// SinceVersion or a later version, and NextSinceVersion is the first version it doesn't have.
+type BackupManifest struct {
+	ToolVersion      string    `json:"toolVersion"`
+	Env              string    `json:"env"`
+	EntityPath       string    `json:"entityPath"`
+	ConsumerGroup    string    `json:"consumerGroup"`
+	Messages         int       `json:"messages"`
+	SinceVersion     uint64    `json:"sinceVersion"`
+	NextSinceVersion uint64    `json:"nextSinceVersion"`
+	Encrypted        bool      `json:"encrypted"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+// EncryptionConfig is where the encryption key of the database and of the dumped files is read from (a file or an
+// environment variable) and the new key used by rotate-key. DecryptPath and DecryptOutput are used by decrypt.
+type EncryptionConfig struct {
+	KeyFile         string `json:"keyFile"`
+	KeyEnv          string `json:"keyEnv"`
+	NewKeyFile      string `json:"newKeyFile"`
+	NewKeyEnv       string `json:"newKeyEnv"`
+	DataKeyRotation string `json:"dataKeyRotation"`
+	EncryptFiles    bool   `json:"encryptFiles"`
+	DecryptPath     string `json:"decryptPath"`
+	DecryptOutput   string `json:"decryptOutput"`
+}
+
+// RetentionConfig is how long messages are kept and how much space they may use. Checkpoints are always kept.
+type RetentionConfig struct {
+	MaxAge         string  `json:"maxAge"`
+	MaxSizeMB      int64   `json:"maxSizeMB"`
+	GcInterval     string  `json:"gcInterval"`
+	GcDiscardRatio float64 `json:"gcDiscardRatio"`
+}
+
+// ExportConfig is the range of messages exported by export2file and printed by query. Every bound is optional and
+// inclusive. Partition is the partition id or, when there's more than one source, <source>/<partition id>.
+type ExportConfig struct {
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Partition     string    `json:"partition"`
+	FromSequence  *int64    `json:"fromSequence"`
+	ToSequence    *int64    `json:"toSequence"`
+	PropertyValue string    `json:"propertyValue"`
+}
+
+// ProtobufConfig is the configuration used to decode protobuf payloads. MessageType is used for every message,
+// unless the event type of the message has a type of its own.
+type ProtobufConfig struct {
+	DescriptorSet     string               `json:"descriptorSet"`
+	MessageType       string               `json:"messageType"`
+	EventTypeProperty string               `json:"eventTypeProperty"`
+	Types             []ProtobufTypeConfig `json:"types"`
+}
+
+// ProtobufTypeConfig is the protobuf message type of the payloads of an event type.
+type ProtobufTypeConfig struct {
+	EventType   string `json:"eventType"`
+	MessageType string `json:"messageType"`
+}
+
+// SchemaValidationConfig is the configuration of the JSON Schemas used to validate message payloads.
+type SchemaValidationConfig struct {
+	EventTypeProperty string         `json:"eventTypeProperty"`
+	Schemas           []SchemaConfig `json:"schemas"`
+}
+
+// SchemaConfig is a JSON Schema file. If EventType is set, it's only used for messages of that event type.
+type SchemaConfig struct {
+	File      string `json:"file"`
+	EventType string `json:"eventType"`
+}
+
+// SourceConfig is an eventhub read by the read operation. Keys not set are taken from the top level of the
+// configuration file.
+type SourceConfig struct {
+	Name                     string   `json:"name"`
+	EventhubConnectionString string   `json:"eventhubConnString"`
+	EntityPath               string   `json:"entityPath"`
+	ConsumerGroup            string   `json:"consumerGroup"`
+	Partitions               []string `json:"partitions"`
+}
+
+// MemoryHubConfig is the configuration of the in-memory eventhub, used when transport is 'memory'.
+type MemoryHubConfig struct {
+	Partitions        int               `json:"partitions"`
+	InitialMessages   int               `json:"initialMessages"`
+	MessagesPerSecond float64           `json:"messagesPerSecond"`
+	BodyTemplate      string            `json:"bodyTemplate"`
+	Properties        map[string]string `json:"properties"`
+	Dir               string            `json:"dir"`
+}
+
+// LoadBalancingConfig is the configuration used to spread the partitions among every instance reading from the same
+// consumer group.
+type LoadBalancingConfig struct {
+	Enabled       bool   `json:"enabled"`
+	LeaseStore    string `json:"leaseStore"`
+	LeaseDir      string `json:"leaseDir"`
+	LeaseDuration string `json:"leaseDuration"`
+	InstanceName  string `json:"instanceName"`
+}
+
+// CommandLineArgs holds the optional arguments passed via command line. When set, they override the values
+// loaded from the configuration file.
+type CommandLineArgs struct {
+	Partitions          string
+	StartPosition       string
+	StartEnqueuedTime   string
+	StartSequenceNumber string
+	MaxMessages         string
+	MaxDuration         string
+	UntilCaughtUp       bool
+	BenchmarkMessages   string
+	Filter              string
+	TailFormat          string
+	ContentEncoding     string
+	PrettyJson          bool
+	Color               bool
+	CaptureDir          string
+	CapturePartition    string
+	ValidationReport    string
+	ExportFrom          string
+	ExportTo            string
+	ExportPartition     string
+	ExportFromSequence  string
+	ExportToSequence    string
+	ExportProperty      string
+	NewKeyFile          string
+	DecryptPath         string
+	DecryptOutput       string
+	BackupFile          string
+	SinceVersion        string
+}
+
+// ReadStats keeps track of what was processed by the read operation and decides when a bounded read must stop.
+type ReadStats struct {
+	mu               sync.Mutex
+	Processed        int64
+	Stored           int64
+	Skipped          int64
+	Invalid          int64
+	LastSeqNumbers   map[string]int64
+	TargetSeqNumbers map[string]int64
+	StopReason       string
+	stopOnce         sync.Once
+	stopped          chan struct{}
+}
+
+// MessageWriter saves messages to badgerDb in batches, flushing them when the batch is full or when asked to.
+// Unless DisableCheckpoints is set, the checkpoints of the partitions are saved together with the messages.
+type MessageWriter struct {
+	db                 *badger.DB
+	batchSize          int
+	filter             *DedupFilter
+	pending            []Message
+	checkpoints        map[string]Message
+	OnWritten          func(msg Message, result WriteResult)
+	DisableCheckpoints bool
+}
+
+// EntryWriter is where badger entries are written: a transaction or a write batch.
+type EntryWriter interface {
+	SetEntry(e *badger.Entry) error
+}
+
+// WriteResult is what happened to a Message given to a MessageWriter.
+type WriteResult int
+
+// MessageFilter selects which messages are saved. A Message matches when it matches every condition.
+type MessageFilter struct {
+	Conditions []FilterCondition
+}
+
+// FilterCondition is a single comparison of a MessageFilter, like: body.tenant == acme
+type FilterCondition struct {
+	Field    string
+	Operator string
+	Value    string
+}
+
+// ProtobufDecoder decodes protobuf payloads to JSON, with the message types of a compiled FileDescriptorSet.
+type ProtobufDecoder struct {
+	eventTypeProperty string
+	byEventType       map[string]protoreflect.MessageDescriptor
+	defaultType       protoreflect.MessageDescriptor
+}
+
+// SchemaValidator validates message payloads against the configured JSON Schemas.
+type SchemaValidator struct {
+	eventTypeProperty string
+	byEventType       map[string][]CompiledSchema
+	defaults          []CompiledSchema
+}
+
+// CompiledSchema is a JSON Schema ready to validate payloads.
+type CompiledSchema struct {
+	Name   string
+	schema *jsonschema.Schema
+}
+
+// SchemaViolation is a rule of a JSON Schema that a Message does not follow.
+type SchemaViolation struct {
+	Key              string
+	Schema           string
+	Rule             string
+	InstanceLocation string
+	Message          string
+}
+
+// ValidationReport groups the violations found by the validate operation by rule.
+type ValidationReport struct {
+	Checked  int
+	Statuses map[string]int
+	Rules    map[string][]SchemaViolation
+}
+
+// StorageStats is how much space the stored messages use, collected by the stats operation.
+// RawBodyBytes is the size of the payloads as they were received and StoredBodyBytes their size once compressed with
+// 'storageCompression'. StoredBytes adds up keys and values, as badger estimates them, and DiskBytes is the size of
+// the database files.
+type StorageStats struct {
+	Messages        int
+	Compressed      int
+	RawBodyBytes    int64
+	StoredBodyBytes int64
+	StoredBytes     int64
+	DiskBytes       int64
+}
+
+// DedupFilter is a bloom filter with the keys already saved to badgerDb. If the filter says a key is not there,
+// it's certainly not, and there's no need to look for it in the database.
+type DedupFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes uint64
+}
+
+// EncryptedWriter encrypts what's written to it with EncryptData, in chunks, and writes each chunk, preceded by its
+// size, to another writer. Close writes an empty chunk, so a reader can tell if the data was truncated.
+type EncryptedWriter struct {
+	writer io.Writer
+	key    []byte
+	buffer []byte
+}
+
+// EncryptedReader decrypts the chunks written by an EncryptedWriter.
+type EncryptedReader struct {
+	reader io.Reader
+	key    []byte
+	chunk  []byte
+	done   bool
+}
+
+// DumpPool writes messages to disk in background, using a fixed number of workers.
+type DumpPool struct {
+	jobs   chan DumpJob
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	Dumped int64
+	Failed int64
+}
+
+// DumpJob is a Message waiting to be written to disk by a DumpPool.
+type DumpJob struct {
+	Msg  Message
+	Path string
+}
+
+// LeaseStore keeps the leases of the partitions (which instance owns each one) and their checkpoints, shared by
+// every instance reading from the same consumer group. It's implemented by FileLeaseStore.
+type LeaseStore interface {
+	List() (map[string]Lease, error)
+	Acquire(partitionId string, owner string, duration time.Duration) (bool, error)
+	Renew(partitionId string, owner string, duration time.Duration) (bool, error)
+	Steal(partitionId string, owner string, duration time.Duration) (bool, error)
+	Release(partitionId string, owner string) error
+	SaveCheckpoint(partitionId string, owner string, checkpoint persist.Checkpoint) (bool, error)
+	LoadCheckpoint(partitionId string) (*persist.Checkpoint, error)
+}
+
+// Lease is the ownership of a partition by an instance, until it expires.
+type Lease struct {
+	PartitionId string              `json:"partitionId"`
+	Owner       string              `json:"owner"`
+	ExpiresAt   time.Time           `json:"expiresAt"`
+	Checkpoint  *persist.Checkpoint `json:"checkpoint"`
+}
+
+// FileLeaseStore is a LeaseStore that keeps one file per partition in a directory shared by every instance.
+type FileLeaseStore struct {
+	dir string
+}
+
+// PartitionBalancer acquires and renews partition leases of a source, so partitions are spread among every running
+// instance, and starts/stops the receivers of the partitions this instance owns.
+type PartitionBalancer struct {
+	source     string
+	store      LeaseStore
+	owner      string
+	duration   time.Duration
+	partitions []string
+	start      func(ctx context.Context, partitionId string) error
+	mu         sync.Mutex
+	owned      map[string]context.CancelFunc
+	stopped    chan struct{}
+}
+
+// HubClient is what this application needs from an eventhub. It's implemented by AmqpHubClient, that talks to
+// Azure Eventhub, and by MemoryHubClient, that allows running everything offline.
+type HubClient interface {
+	Send(ctx context.Context, event *eventhub.Event) error
+	SendBatch(ctx context.Context, events []*eventhub.Event) error
+	Receive(ctx context.Context, partitionId string, handler eventhub.Handler, opts ReceiveOptions) error
+	GetRuntimeInformation(ctx context.Context) (*eventhub.HubRuntimeInformation, error)
+	GetPartitionInformation(ctx context.Context, partitionId string) (*eventhub.HubPartitionRuntimeInformation, error)
+	Close(ctx context.Context) error
+}
+
+// ReceiveOptions defines how a partition receiver is created.
+// StartOffset is exclusive and accepts persist.StartOfStream and persist.EndOfStream. If it's empty, StartTime
+// is used. If both are empty, the receiver starts at the default position of the eventhub.
+type ReceiveOptions struct {
+	ConsumerGroup string
+	StartOffset   string
+	StartTime     time.Time
+}
+
+// AmqpHubClient is the HubClient that talks to Azure Eventhub, using the official SDK.
+type AmqpHubClient struct {
+	hub *eventhub.Hub
+}
+
+// MemoryHubClient is a HubClient of an in-memory eventhub. Clients of the same entity path share the eventhub, so
+// messages sent by one are received by the others.
+type MemoryHubClient struct {
+	hub       *memoryHub
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// memoryHub is an in-memory eventhub, with fake messages generated as configured. If 'memoryHub.dir' is set, its
+// events are also saved to files, so they're kept between runs.
+type memoryHub struct {
+	path           string
+	createdAt      time.Time
+	partitions     map[string]*memoryPartition
+	ids            []string
+	mu             sync.Mutex
+	sent           int
+	clients        int
+	stopGenerating chan struct{}
+}
+
+// memoryPartition is a partition of a memoryHub.
+type memoryPartition struct {
+	id         string
+	mu         sync.Mutex
+	cond       *sync.Cond
+	events     []*eventhub.Event
+	nextOffset int64
+	file       *os.File
+}
+
+// memoryEvent is an event of a memoryPartition, as it's saved to the file of the partition (one JSON per line).
+// Its sequence number is its line number, starting at 0.
+type memoryEvent struct {
+	Id           string                 `json:"id"`
+	Data         []byte                 `json:"data"`
+	Properties   map[string]interface{} `json:"properties,omitempty"`
+	PartitionKey *string                `json:"partitionKey,omitempty"`
+	EnqueuedTime time.Time              `json:"enqueuedTime"`
+	Offset       int64                  `json:"offset"`
 }
 
 // application constants
@@ -47,13 +504,137 @@ const (
 	messageDumpDir         = ".\\.data-dump\\eventhub"
 	outboundFolder         = ".\\.outbound"
 	outboundFolderSent     = ".\\.outbound\\.sent"
-	readToFile             = false
 	colorBlue              = "\033[34m"
 	colorReset             = "\033[0m"
 	defaultConfigFile      = ".\\default.conf.json"
 	badgerValueLogFileSize = 10485760
+	badgerIndexCacheSize   = 104857600
+	reservedKeyPrefix      = "__hubtools__/"
+	checkpointKeyPrefix    = reservedKeyPrefix + "checkpoint/"
+	indexKeyPrefix         = reservedKeyPrefix + "idx/"
+	gcInterval             = "10m"
+	gcDiscardRatio         = 0.5
+	storageMagic           = "HTM"
+	storageFormatGob       = 0
+	storageFormatJson      = 1
+	storageFormatVersion   = 2
+	encryptedFileMagic     = "HTE"
+	encryptedFileVersion   = 1
+	encryptedFileExtension = ".enc"
+	encryptedChunkSize     = 1048576
+	dataKeyRotation        = "10d"
+	backupManifestSuffix   = ".manifest.json"
+	backupMaxPendingWrites = 256
+	messageKeyPrefix       = "msg/"
+	contentTypeProperty    = "content-type"
+	contentTypeJson        = "application/json"
+	contentTypeBinary      = "application/octet-stream"
+	encodingProperty       = "content-encoding"
+	batchSize              = 500
+	batchFlushInterval     = "1s"
+	dedupFilterCapacity    = 1000000
+	benchmarkMessages      = 20000
+	dumpWorkers            = 4
+	dumpQueueSize          = 1000
+	shutdownTimeout        = "30s"
+	leaseDuration          = "30s"
+	leaseStoreFile         = "file"
+	validationReport       = ".\\validation-report.txt"
+	validationExamples     = 20
+	memoryHubPartitions    = 4
+	memoryHubFileExtension = ".jsonl"
+	memoryHubBodyTemplate  = `{"id":"{{id}}","partition":"{{partition}}","sequenceNumber":{{seq}},"createdAt":"{{time}}"}`
 )
 
+// results of writing a Message
+const (
+	writeResultDuplicate WriteResult = iota
+	writeResultStored
+	writeResultSkipped
+)
+
+// operators supported by filter conditions
+const (
+	filterOperatorEqual        = "=="
+	filterOperatorNotEqual     = "!="
+	filterOperatorGreater      = ">"
+	filterOperatorGreaterEqual = ">="
+	filterOperatorLess         = "<"
+	filterOperatorLessEqual    = "<="
+	filterOperatorContains     = "contains"
+	filterOperatorExists       = "exists"
+)
+
+// strategies supported to build the key used to detect duplicated messages
+const (
+	dedupKeyEventId           = "eventId"
+	dedupKeyPartitionSequence = "partitionSequence"
+	dedupKeyBodyHash          = "bodyHash"
+	dedupKeyProperty          = "property"
+)
+
+// results of validating a Message against the JSON Schemas
+const (
+	validationStatusValid    = "valid"
+	validationStatusInvalid  = "invalid"
+	validationStatusNoSchema = "no-schema"
+)
+
+// compressions supported for payloads saved to badgerDb and for badger blocks
+const (
+	storageCompressionNone   = "none"
+	storageCompressionSnappy = "snappy"
+	storageCompressionZstd   = "zstd"
+)
+
+// payload compressions supported (content-encoding)
+const (
+	contentEncodingGzip    = "gzip"
+	contentEncodingDeflate = "deflate"
+	contentEncodingZstd    = "zstd"
+)
+
+// formats supported by the tail operation
+const (
+	tailFormatDetails = "details"
+	tailFormatLine    = "line"
+	tailFormatJsonl   = "jsonl"
+)
+
+// transports supported to talk to an eventhub
+const (
+	transportAmqp   = "amqp"
+	transportMemory = "memory"
+)
+
+// start positions supported by the read operation
+const (
+	startPositionCheckpoint     = "checkpoint"
+	startPositionEarliest       = "earliest"
+	startPositionLatest         = "latest"
+	startPositionEnqueuedTime   = "enqueued-time"
+	startPositionSequenceNumber = "sequence-number"
+)
+
+// reasons that make a bounded read stop
+const (
+	stopReasonMaxMessages = "maximum number of messages reached"
+	stopReasonMaxDuration = "maximum duration reached"
+	stopReasonCaughtUp    = "caught up with every partition"
+	stopReasonInterrupted = "interrupted by the user"
+)
+
+// exit codes
+const (
+	exitCodeSuccess     = 0
+	exitCodeFailure     = 1
+	exitCodeNotCaughtUp = 2
+)
+
+// operations (verbs) supported via command line
+var supportedOperations = []string{"read", "tail", "import-capture", "validate", "export2file", "query", "reindex",
+	"migrate", "prune", "stats", "rotate-key", "decrypt", "backup", "restore", "write", "benchmark"}
+
 // global variables
 var messageChannel chan Message
 var pBar *progressbar.ProgressBar
@@ -61,5 +642,25 @@ var badgerConnection *badger.DB
 var dataDumpDir string
 var appDir string
 var currentConfig Config
+var cmdArgs CommandLineArgs
 var exitCode int
+var readStats *ReadStats
+var maxReadDuration time.Duration
+var flushInterval time.Duration
+var dumpPool *DumpPool
+var gracefulShutdownTimeout time.Duration
+var messageFilter *MessageFilter
+var schemaValidator *SchemaValidator
+var protobufDecoder *ProtobufDecoder
+var leaseBalancers = make(map[string]*PartitionBalancer)
+var memoryHubs = make(map[string]*memoryHub)
+var memoryHubsMu sync.Mutex
+var partitionLeaseDuration time.Duration
+var retentionMaxAge time.Duration
+var valueLogGcInterval time.Duration
+var encryptionKey []byte
+var dataKeyRotationDuration time.Duration
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
 var start time.Time
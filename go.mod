@@ -4,17 +4,22 @@ go 1.16
 
 require (
 	github.com/Azure/azure-amqp-common-go/v3 v3.1.0 // indirect
-	github.com/Azure/azure-event-hubs-go/v3 v3.3.11 // indirect
+	github.com/Azure/azure-event-hubs-go/v3 v3.3.11
 	github.com/Azure/azure-sdk-for-go v55.8.0+incompatible // indirect
 	github.com/Azure/go-amqp v0.13.9 // indirect
 	github.com/Azure/go-autorest/autorest v0.11.19 // indirect
 	github.com/Azure/go-autorest/autorest/adal v0.9.14 // indirect
-	github.com/dgraph-io/badger/v3 v3.2103.1 // indirect
+	github.com/dgraph-io/badger/v3 v3.2103.1
 	github.com/form3tech-oss/jwt-go v3.2.3+incompatible // indirect
+	github.com/golang/snappy v0.0.3
 	github.com/jpillora/backoff v1.0.0 // indirect
+	github.com/klauspost/compress v1.12.3
+	github.com/linkedin/goavro/v2 v2.10.1
 	github.com/mitchellh/mapstructure v1.4.1 // indirect
-	github.com/schollz/progressbar/v3 v3.8.2 // indirect
+	github.com/santhosh-tekuri/jsonschema/v5 v5.0.0
+	github.com/schollz/progressbar/v3 v3.8.2
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
 	golang.org/x/net v0.0.0-20210716203947-853a461950ff // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	google.golang.org/protobuf v1.27.1
 )
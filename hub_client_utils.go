@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewHubClient creates the HubClient for the configured transport.
+// Will panic in case of failure.
+//
+// Parameters:
+//  connectionString: connection string that will be used to open a connection to Eventhub
+//  entityPath: name of the entity path (eventhub) that will be targeted.
+//
+// Returns:
+//  new HubClient.
+func NewHubClient(connectionString string, entityPath string) HubClient {
+	if currentConfig.Transport == transportMemory {
+		return NewMemoryHubClient(entityPath, currentConfig.MemoryHub)
+	}
+
+	if !strings.Contains(connectionString, ";EntityPath=") {
+		connectionString = fmt.Sprintf("%s;EntityPath=%s", connectionString, entityPath)
+	}
+
+	hub, err := eventhub.NewHubFromConnectionString(connectionString)
+	HandleError("Failed to create new EventHub client from connection string", err, true)
+	return &AmqpHubClient{hub: hub}
+}
+
+// Send sends an event to the eventhub.
+//
+// Parameters:
+//  ctx: context of the operation.
+//  event: event that will be sent.
+//
+// Receiver:
+//  Instance of AmqpHubClient.
+//
+// Returns:
+//  error if the event could not be sent.
+func (c *AmqpHubClient) Send(ctx context.Context, event *eventhub.Event) error {
+	return c.hub.Send(ctx, event)
+}
+
+// SendBatch sends events to the eventhub, in as few batches as possible.
+//
+// Parameters:
+//  ctx: context of the operation.
+//  events: events that will be sent.
+//
+// Receiver:
+//  Instance of AmqpHubClient.
+//
+// Returns:
+//  error if the events could not be sent.
+func (c *AmqpHubClient) SendBatch(ctx context.Context, events []*eventhub.Event) error {
+	return c.hub.SendBatch(ctx, eventhub.NewEventBatchIterator(events...))
+}
+
+// Receive starts receiving events from a partition. Events are passed to the handler until the client is closed
+// or the context is cancelled.
+//
+// Parameters:
+//  ctx: context of the receiver. once it's cancelled, the receiver is closed.
+//  partitionId: id of the partition.
+//  handler: function that will be called for each event.
+//  opts: options of the receiver.
+//
+// Receiver:
+//  Instance of AmqpHubClient.
+//
+// Returns:
+//  error if the receiver could not be created.
+func (c *AmqpHubClient) Receive(ctx context.Context, partitionId string, handler eventhub.Handler, opts ReceiveOptions) error {
+	sdkOpts := []eventhub.ReceiveOption{eventhub.ReceiveWithConsumerGroup(opts.ConsumerGroup)}
+
+	if opts.StartOffset == persist.EndOfStream {
+		sdkOpts = append(sdkOpts, eventhub.ReceiveWithLatestOffset())
+	} else if opts.StartOffset != "" {
+		sdkOpts = append(sdkOpts, eventhub.ReceiveWithStartingOffset(opts.StartOffset))
+	} else if !opts.StartTime.IsZero() {
+		sdkOpts = append(sdkOpts, eventhub.ReceiveFromTimestamp(opts.StartTime))
+	}
+
+	handle, err := c.hub.Receive(ctx, partitionId, handler, sdkOpts...)
+	if err != nil || ctx.Done() == nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = handle.Close(context.Background())
+	}()
+
+	return nil
+}
+
+// GetRuntimeInformation fetches runtime information of the eventhub.
+//
+// Parameters:
+//  ctx: context of the operation.
+//
+// Receiver:
+//  Instance of AmqpHubClient.
+//
+// Returns:
+//  runtime information and error, if it could not be fetched.
+func (c *AmqpHubClient) GetRuntimeInformation(ctx context.Context) (*eventhub.HubRuntimeInformation, error) {
+	return c.hub.GetRuntimeInformation(ctx)
+}
+
+// GetPartitionInformation fetches runtime information of a partition.
+//
+// Parameters:
+//  ctx: context of the operation.
+//  partitionId: id of the partition.
+//
+// Receiver:
+//  Instance of AmqpHubClient.
+//
+// Returns:
+//  runtime information of the partition and error, if it could not be fetched.
+func (c *AmqpHubClient) GetPartitionInformation(ctx context.Context, partitionId string) (*eventhub.HubPartitionRuntimeInformation, error) {
+	return c.hub.GetPartitionInformation(ctx, partitionId)
+}
+
+// Close closes every receiver and sender opened by the client.
+//
+// Parameters:
+//  ctx: context of the operation.
+//
+// Receiver:
+//  Instance of AmqpHubClient.
+//
+// Returns:
+//  error if the client could not be closed.
+func (c *AmqpHubClient) Close(ctx context.Context) error {
+	return c.hub.Close(ctx)
+}
+
+// NewMemoryHubClient creates a client of the in-memory eventhub of an entity path. The eventhub is created, with its
+// initial messages, by the first client, and shared by every client of the same entity path. While any of them is
+// open, new messages are generated at the configured rate.
+//
+// Parameters:
+//  path: name of the fake eventhub.
+//  cfg: configuration of the in-memory eventhub.
+//
+// Returns:
+//  new instance of MemoryHubClient.
+func NewMemoryHubClient(path string, cfg MemoryHubConfig) *MemoryHubClient {
+	memoryHubsMu.Lock()
+	hub, found := memoryHubs[path]
+	if !found {
+		hub = newMemoryHub(path, cfg)
+		memoryHubs[path] = hub
+	}
+	memoryHubsMu.Unlock()
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.clients++
+	if hub.clients == 1 && cfg.MessagesPerSecond > 0 {
+		hub.stopGenerating = make(chan struct{})
+		for _, id := range hub.ids {
+			go hub.generate(cfg, hub.partitions[id], hub.stopGenerating)
+		}
+	}
+
+	return &MemoryHubClient{
+		hub:    hub,
+		closed: make(chan struct{}),
+	}
+}
+
+// newMemoryHub creates an in-memory eventhub. If 'memoryHub.dir' is set, the events saved by previous runs are
+// loaded. Partitions without events get the initial messages.
+// Will panic in case of failure.
+//
+// Parameters:
+//  path: name of the fake eventhub.
+//  cfg: configuration of the in-memory eventhub.
+//
+// Returns:
+//  new instance of memoryHub.
+func newMemoryHub(path string, cfg MemoryHubConfig) *memoryHub {
+	hub := &memoryHub{
+		path:       path,
+		createdAt:  time.Now(),
+		partitions: make(map[string]*memoryPartition),
+	}
+
+	for i := 0; i < cfg.Partitions; i++ {
+		p := &memoryPartition{id: strconv.Itoa(i)}
+		p.cond = sync.NewCond(&p.mu)
+		if cfg.Dir != "" {
+			p.load(filepath.Join(cfg.Dir, path, p.id+memoryHubFileExtension))
+		}
+		hub.partitions[p.id] = p
+		hub.ids = append(hub.ids, p.id)
+
+		if len(p.events) > 0 {
+			continue
+		}
+		for j := 0; j < cfg.InitialMessages; j++ {
+			p.append(func(seq int64) *eventhub.Event {
+				return GenerateMemoryEvent(cfg, p.id, seq)
+			})
+		}
+	}
+
+	return hub
+}
+
+// GenerateMemoryEvent creates a fake event for a partition, based on the body template and properties configured.
+// The template accepts the placeholders {{id}}, {{partition}}, {{seq}} and {{time}}.
+//
+// Parameters:
+//  cfg: configuration of the in-memory eventhub.
+//  partitionId: id of the partition the event will be added to.
+//  seq: sequence number the event will have.
+//
+// Returns:
+//  new fake event.
+func GenerateMemoryEvent(cfg MemoryHubConfig, partitionId string, seq int64) *eventhub.Event {
+	id := fmt.Sprintf("memory-%s-%d-%d", partitionId, seq, time.Now().UnixNano())
+	body := strings.NewReplacer(
+		"{{id}}", id,
+		"{{partition}}", partitionId,
+		"{{seq}}", strconv.FormatInt(seq, 10),
+		"{{time}}", time.Now().Format(time.RFC3339Nano),
+	).Replace(cfg.BodyTemplate)
+
+	event := eventhub.NewEventFromString(body)
+	event.ID = id
+	for key, value := range cfg.Properties {
+		event.Set(key, value)
+	}
+
+	return event
+}
+
+// generate is the routine that adds new fake events to a partition, at the configured rate.
+//
+// Parameters:
+//  cfg: configuration of the in-memory eventhub.
+//  p: partition that will receive the events.
+//  stop: channel that is closed when events must not be generated anymore.
+//
+// Receiver:
+//  Instance of memoryHub.
+//
+// Returns:
+//  Nothing.
+func (h *memoryHub) generate(cfg MemoryHubConfig, p *memoryPartition, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.MessagesPerSecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.append(func(seq int64) *eventhub.Event {
+				return GenerateMemoryEvent(cfg, p.id, seq)
+			})
+		}
+	}
+}
+
+// Send adds an event to a partition. Events with a partition key always go to the same partition. Other events
+// are spread across partitions.
+//
+// Parameters:
+//  _: context of the operation. Not used.
+//  event: event that will be sent.
+//
+// Receiver:
+//  Instance of MemoryHubClient.
+//
+// Returns:
+//  error if the client is closed.
+func (c *MemoryHubClient) Send(_ context.Context, event *eventhub.Event) error {
+	select {
+	case <-c.closed:
+		return fmt.Errorf("in-memory eventhub '%s' is closed", c.hub.path)
+	default:
+	}
+
+	hub := c.hub
+	hub.mu.Lock()
+	index := hub.sent % len(hub.ids)
+	hub.sent++
+	hub.mu.Unlock()
+
+	if event.PartitionKey != nil {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(*event.PartitionKey))
+		index = int(h.Sum32() % uint32(len(hub.ids)))
+	}
+
+	hub.partitions[hub.ids[index]].append(func(int64) *eventhub.Event {
+		return event
+	})
+	return nil
+}
+
+// SendBatch adds events to the partitions, one by one.
+//
+// Parameters:
+//  ctx: context of the operation.
+//  events: events that will be sent.
+//
+// Receiver:
+//  Instance of MemoryHubClient.
+//
+// Returns:
+//  error if the client is closed.
+func (c *MemoryHubClient) SendBatch(ctx context.Context, events []*eventhub.Event) error {
+	for _, event := range events {
+		if err := c.Send(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receive starts a routine that passes the events of a partition to the handler, from the start position and
+// waiting for new ones, until the client is closed or the context is cancelled.
+//
+// Parameters:
+//  ctx: context of the receiver, passed to the handler. once it's cancelled, the receiver stops.
+//  partitionId: id of the partition.
+//  handler: function that will be called for each event.
+//  opts: options of the receiver. The consumer group is ignored.
+//
+// Receiver:
+//  Instance of MemoryHubClient.
+//
+// Returns:
+//  error if the partition does not exist.
+func (c *MemoryHubClient) Receive(ctx context.Context, partitionId string, handler eventhub.Handler, opts ReceiveOptions) error {
+	p, found := c.hub.partitions[partitionId]
+	if !found {
+		return fmt.Errorf("partition '%s' does not exist", partitionId)
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		}()
+	}
+
+	go func() {
+		for next := p.startIndex(opts); ; next++ {
+			event, ok := p.wait(ctx, c.closed, next)
+			if !ok {
+				return
+			}
+			_ = handler(ctx, event)
+		}
+	}()
+
+	return nil
+}
+
+// GetRuntimeInformation returns the runtime information of the in-memory eventhub.
+//
+// Parameters:
+//  _: context of the operation. Not used.
+//
+// Receiver:
+//  Instance of MemoryHubClient.
+//
+// Returns:
+//  runtime information. error is always nil.
+func (c *MemoryHubClient) GetRuntimeInformation(_ context.Context) (*eventhub.HubRuntimeInformation, error) {
+	return &eventhub.HubRuntimeInformation{
+		Path:           c.hub.path,
+		CreatedAt:      c.hub.createdAt,
+		PartitionCount: len(c.hub.ids),
+		PartitionIDs:   c.hub.ids,
+	}, nil
+}
+
+// GetPartitionInformation returns the runtime information of a partition of the in-memory eventhub.
+//
+// Parameters:
+//  _: context of the operation. Not used.
+//  partitionId: id of the partition.
+//
+// Receiver:
+//  Instance of MemoryHubClient.
+//
+// Returns:
+//  runtime information of the partition and error, if the partition does not exist.
+func (c *MemoryHubClient) GetPartitionInformation(_ context.Context, partitionId string) (*eventhub.HubPartitionRuntimeInformation, error) {
+	p, found := c.hub.partitions[partitionId]
+	if !found {
+		return nil, fmt.Errorf("partition '%s' does not exist", partitionId)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info := &eventhub.HubPartitionRuntimeInformation{
+		HubPath:                 c.hub.path,
+		PartitionID:             partitionId,
+		BeginningSequenceNumber: 0,
+		LastSequenceNumber:      int64(len(p.events)) - 1,
+		LastEnqueuedOffset:      persist.StartOfStream,
+	}
+
+	if last := len(p.events) - 1; last >= 0 {
+		info.LastEnqueuedOffset = strconv.FormatInt(*p.events[last].SystemProperties.Offset, 10)
+		info.LastEnqueuedTimeUtc = *p.events[last].SystemProperties.EnqueuedTime
+	}
+
+	return info, nil
+}
+
+// Close stops the receivers of the client. When the last client of the in-memory eventhub is closed, new events are
+// not generated anymore. Events are kept, for the clients created later.
+//
+// Parameters:
+//  _: context of the operation. Not used.
+//
+// Receiver:
+//  Instance of MemoryHubClient.
+//
+// Returns:
+//  error is always nil.
+func (c *MemoryHubClient) Close(_ context.Context) error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		for _, p := range c.hub.partitions {
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		}
+
+		c.hub.mu.Lock()
+		defer c.hub.mu.Unlock()
+		c.hub.clients--
+		if c.hub.clients == 0 && c.hub.stopGenerating != nil {
+			close(c.hub.stopGenerating)
+			c.hub.stopGenerating = nil
+		}
+	})
+	return nil
+}
+
+// append adds a new event to the partition, filling its system properties like eventhub does: sequence numbers
+// follow each other and offsets are byte positions that always grow, even for empty events. The event is also saved
+// to the file of the partition, if there's one.
+// Will panic in case of failure.
+//
+// Parameters:
+//  newEvent: function that creates the event, given the sequence number it will have.
+//
+// Receiver:
+//  Instance of memoryPartition.
+//
+// Returns:
+//  Nothing.
+func (p *memoryPartition) append(newEvent func(seq int64) *eventhub.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	seq := int64(len(p.events))
+	offset := p.nextOffset
+	enqueuedTime := time.Now().UTC()
+	event := newEvent(seq)
+	event.SystemProperties = &eventhub.SystemProperties{
+		SequenceNumber: &seq,
+		Offset:         &offset,
+		EnqueuedTime:   &enqueuedTime,
+		PartitionKey:   event.PartitionKey,
+	}
+
+	if p.file != nil {
+		p.save(event)
+	}
+
+	p.events = append(p.events, event)
+	// Every event takes at least one byte, so no two events share an offset.
+	p.nextOffset += int64(len(event.Data)) + 1
+	p.cond.Broadcast()
+}
+
+// load reads the events saved to the file of the partition by previous runs, and opens the file to save new ones.
+// Will panic in case of failure.
+//
+// Parameters:
+//  path: file of the partition.
+//
+// Receiver:
+//  Instance of memoryPartition.
+//
+// Returns:
+//  Nothing.
+func (p *memoryPartition) load(path string) {
+	EnsureDirExists(filepath.Dir(path))
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		HandleError(fmt.Sprintf("Failed to read in-memory eventhub file '%s'.", path), err, true)
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		saved := memoryEvent{}
+		err = json.Unmarshal(line, &saved)
+		HandleError(fmt.Sprintf("Failed to parse in-memory eventhub file '%s'.", path), err, true)
+
+		seq := int64(len(p.events))
+		event := eventhub.NewEvent(saved.Data)
+		event.ID = saved.Id
+		event.Properties = saved.Properties
+		event.PartitionKey = saved.PartitionKey
+		event.SystemProperties = &eventhub.SystemProperties{
+			SequenceNumber: &seq,
+			Offset:         &saved.Offset,
+			EnqueuedTime:   &saved.EnqueuedTime,
+			PartitionKey:   saved.PartitionKey,
+		}
+		p.events = append(p.events, event)
+		p.nextOffset = saved.Offset + int64(len(saved.Data)) + 1
+	}
+
+	p.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	HandleError(fmt.Sprintf("Failed to open in-memory eventhub file '%s'.", path), err, true)
+}
+
+// save appends an event to the file of the partition.
+// Will panic in case of failure.
+//
+// Parameters:
+//  event: event that will be saved. its system properties must be set.
+//
+// Receiver:
+//  Instance of memoryPartition.
+//
+// Returns:
+//  Nothing.
+func (p *memoryPartition) save(event *eventhub.Event) {
+	data, err := json.Marshal(memoryEvent{
+		Id:           event.ID,
+		Data:         event.Data,
+		Properties:   event.Properties,
+		PartitionKey: event.PartitionKey,
+		EnqueuedTime: *event.SystemProperties.EnqueuedTime,
+		Offset:       *event.SystemProperties.Offset,
+	})
+	if err == nil {
+		_, err = p.file.Write(append(data, '\n'))
+	}
+	HandleError(fmt.Sprintf("Failed to save event to in-memory eventhub file '%s'.", p.file.Name()), err, true)
+}
+
+// startIndex returns the index of the first event a receiver with the given options must receive.
+//
+// Parameters:
+//  opts: options of the receiver.
+//
+// Receiver:
+//  Instance of memoryPartition.
+//
+// Returns:
+//  index of the first event to receive.
+func (p *memoryPartition) startIndex(opts ReceiveOptions) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case opts.StartOffset == persist.EndOfStream:
+		return len(p.events)
+
+	case opts.StartOffset != "" && opts.StartOffset != persist.StartOfStream:
+		offset, err := strconv.ParseInt(opts.StartOffset, 10, 64)
+		if err != nil {
+			return 0
+		}
+		for i, event := range p.events {
+			if *event.SystemProperties.Offset > offset {
+				return i
+			}
+		}
+		return len(p.events)
+
+	case opts.StartOffset == "" && !opts.StartTime.IsZero():
+		for i, event := range p.events {
+			if event.SystemProperties.EnqueuedTime.After(opts.StartTime) {
+				return i
+			}
+		}
+		return len(p.events)
+	}
+
+	return 0
+}
+
+// wait blocks until the event at the given index exists, the client is closed or the context is cancelled.
+//
+// Parameters:
+//  ctx: context of the receiver.
+//  closed: channel that is closed when the client of the receiver is closed.
+//  index: index of the event.
+//
+// Receiver:
+//  Instance of memoryPartition.
+//
+// Returns:
+//  the event and true, or nil and false if the client was closed or the context was cancelled.
+func (p *memoryPartition) wait(ctx context.Context, closed <-chan struct{}, index int) (*eventhub.Event, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for index >= len(p.events) && !isClosed(closed) && ctx.Err() == nil {
+		p.cond.Wait()
+	}
+
+	if isClosed(closed) || ctx.Err() != nil {
+		return nil, false
+	}
+
+	return p.events[index], true
+}
+
+// isClosed checks if a channel was closed, without blocking.
+//
+// Parameters:
+//  ch: channel that will be checked.
+//
+// Returns:
+//  true if the channel was closed. false otherwise.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
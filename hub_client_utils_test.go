@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"sync"
+	"testing"
+)
+
+// TestMemoryPartitionOffsets checks that offsets keep growing, even for events with an empty body.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestMemoryPartitionOffsets(t *testing.T) {
+	defer resetMemoryHubs()
+	client := NewMemoryHubClient("offsets", MemoryHubConfig{Partitions: 1})
+	defer func() { _ = client.Close(context.Background()) }()
+
+	for _, body := range []string{"", "", "body", ""} {
+		if err := client.Send(context.Background(), eventhub.NewEventFromString(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := client.hub.partitions["0"].events
+	for i := 1; i < len(events); i++ {
+		if *events[i].SystemProperties.Offset <= *events[i-1].SystemProperties.Offset {
+			t.Errorf("offset of event %d is %d, after %d", i, *events[i].SystemProperties.Offset,
+				*events[i-1].SystemProperties.Offset)
+		}
+	}
+}
+
+// TestMemoryHubSequenceNumbers sends events from several goroutines and checks that sequence numbers follow each
+// other, with no duplicates.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestMemoryHubSequenceNumbers(t *testing.T) {
+	defer resetMemoryHubs()
+	client := NewMemoryHubClient("sequence", MemoryHubConfig{Partitions: 1, InitialMessages: 5})
+	defer func() { _ = client.Close(context.Background()) }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = client.Send(context.Background(), eventhub.NewEventFromString("event"))
+		}()
+	}
+	wg.Wait()
+
+	events := client.hub.partitions["0"].events
+	if len(events) != 25 {
+		t.Fatalf("partition has %d events, want 25", len(events))
+	}
+	for i, event := range events {
+		if *event.SystemProperties.SequenceNumber != int64(i) {
+			t.Errorf("event %d has sequence number %d", i, *event.SystemProperties.SequenceNumber)
+		}
+	}
+}
+
+// TestMemoryHubShared checks that clients of the same entity path share the in-memory eventhub.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestMemoryHubShared(t *testing.T) {
+	defer resetMemoryHubs()
+	writer := NewMemoryHubClient("shared", MemoryHubConfig{Partitions: 1})
+	if err := writer.Send(context.Background(), eventhub.NewEventFromString("event")); err != nil {
+		t.Fatal(err)
+	}
+	_ = writer.Close(context.Background())
+
+	reader := NewMemoryHubClient("shared", MemoryHubConfig{Partitions: 1})
+	defer func() { _ = reader.Close(context.Background()) }()
+	info, _ := reader.GetPartitionInformation(context.Background(), "0")
+	if info.LastSequenceNumber != 0 {
+		t.Errorf("last sequence number is %d, want 0", info.LastSequenceNumber)
+	}
+}
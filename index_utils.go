@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GetIndexKeys returns the secondary index keys of a Message. The value of each index key is the Message key.
+// Index keys are sortable, so ranges can be scanned without reading every message:
+//  - __hubtools__/idx/time/<enqueued time (unix nano)>/<message key>
+//  - __hubtools__/idx/seq/<source>/<partition id>/<sequence number>/<message key>
+//  - __hubtools__/idx/prop/<property>/<value>/<message key> (only if 'indexProperty' is set)
+//
+// Parameters:
+//  msg: Message that will be indexed.
+//
+// Returns:
+//  index keys of the Message.
+func GetIndexKeys(msg Message) [][]byte {
+	var keys [][]byte
+	if !msg.QueuedTime.IsZero() && msg.QueuedTime.UnixNano() >= 0 {
+		keys = append(keys, []byte(fmt.Sprintf("%s%020d/%s",
+			GetTimeIndexPrefix(), msg.QueuedTime.UnixNano(), msg.Key)))
+	}
+
+	if msg.EventSeqNumber != nil && *msg.EventSeqNumber >= 0 {
+		keys = append(keys, []byte(fmt.Sprintf("%s%020d/%s",
+			GetSequenceIndexPrefix(msg.Source, msg.PartitionId), *msg.EventSeqNumber, msg.Key)))
+	}
+
+	if currentConfig.IndexProperty != "" {
+		if value, found := msg.Properties[currentConfig.IndexProperty]; found {
+			keys = append(keys, []byte(GetPropertyIndexPrefix(value)+msg.Key))
+		}
+	}
+
+	return keys
+}
+
+// GetTimeIndexPrefix returns the prefix of the keys of the enqueued time index.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  prefix of the index keys.
+func GetTimeIndexPrefix() string {
+	return indexKeyPrefix + "time/"
+}
+
+// GetSequenceIndexPrefix returns the prefix of the keys of the sequence number index of a partition.
+//
+// Parameters:
+//  source: name of the source.
+//  partitionId: id of the partition.
+//
+// Returns:
+//  prefix of the index keys.
+func GetSequenceIndexPrefix(source string, partitionId string) string {
+	return fmt.Sprintf("%sseq/%s/%s/", indexKeyPrefix, source, partitionId)
+}
+
+// GetPropertyIndexPrefix returns the prefix of the keys of the messages whose indexed property has a value.
+//
+// Parameters:
+//  value: value of the property configured in 'indexProperty'.
+//
+// Returns:
+//  prefix of the index keys.
+func GetPropertyIndexPrefix(value string) string {
+	return fmt.Sprintf("%sprop/%s/%s/", indexKeyPrefix,
+		url.PathEscape(currentConfig.IndexProperty), url.PathEscape(value))
+}
+
+// SetIndexKeys adds the index keys of a Message to the transaction or write batch where the Message is saved, so
+// they're written together. Index keys expire together with the Message.
+//
+// Parameters:
+//  writer: transaction or write batch where the Message is saved.
+//  msg: Message that will be indexed.
+//  expiresAt: expiration of the Message, as unix time in seconds. 0 if it never expires.
+//
+// Returns:
+//  error if the keys could not be added.
+func SetIndexKeys(writer EntryWriter, msg Message, expiresAt uint64) error {
+	for _, key := range GetIndexKeys(msg) {
+		if err := writer.SetEntry(NewStoredEntry(key, []byte(msg.Key), expiresAt)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RebuildIndexes deletes every index key and indexes every message in the database again. Needed for messages
+// saved before indexes existed, or after 'indexProperty' changes.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database that will be indexed.
+//
+// Returns:
+//  number of messages indexed.
+func RebuildIndexes(db *badger.DB) int {
+	err := db.DropPrefix([]byte(indexKeyPrefix))
+	HandleError("Failed to delete indexes.", err, true)
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	indexed := 0
+	err = db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			dbRow := iter.Item()
+			if IsReservedKey(dbRow.Key()) {
+				continue
+			}
+
+			key := string(dbRow.KeyCopy(nil))
+			err := dbRow.Value(func(val []byte) error {
+				msg := Deserialize(val)
+				msg.Key = key
+				return SetIndexKeys(wb, *msg, dbRow.ExpiresAt())
+			})
+			if err != nil {
+				return err
+			}
+
+			indexed++
+			if pBar != nil {
+				_ = pBar.Add(1)
+			}
+		}
+		return nil
+	})
+	HandleError("Failed to index messages.", err, true)
+	HandleError("Failed to save indexes.", wb.Flush(), true)
+
+	return indexed
+}
+
+// IsSet checks if any bound of the export range was configured.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ExportConfig.
+//
+// Returns:
+//  true if only some messages should be exported. false if every message should.
+func (e ExportConfig) IsSet() bool {
+	return !e.From.IsZero() || !e.To.IsZero() || e.Partition != "" || e.FromSequence != nil ||
+		e.ToSequence != nil || e.PropertyValue != ""
+}
+
+// GetPartition returns the source and the partition id of the exported partition.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ExportConfig.
+//
+// Returns:
+//  name of the source and partition id. Empty if no partition was configured.
+func (e ExportConfig) GetPartition() (string, string) {
+	if e.Partition == "" {
+		return "", ""
+	}
+
+	if parts := strings.SplitN(e.Partition, "/", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+
+	return currentConfig.Sources[0].Name, e.Partition
+}
+
+// Matches checks if a Message is inside the export range.
+//
+// Parameters:
+//  msg: Message that will be checked.
+//
+// Receiver:
+//  Instance of ExportConfig.
+//
+// Returns:
+//  true if the Message is inside every configured bound. false otherwise.
+func (e ExportConfig) Matches(msg Message) bool {
+	if (!e.From.IsZero() && msg.QueuedTime.Before(e.From)) || (!e.To.IsZero() && msg.QueuedTime.After(e.To)) {
+		return false
+	}
+
+	if source, partitionId := e.GetPartition(); partitionId != "" &&
+		(msg.Source != source || msg.PartitionId != partitionId) {
+		return false
+	}
+
+	if e.FromSequence != nil || e.ToSequence != nil {
+		if msg.EventSeqNumber == nil ||
+			(e.FromSequence != nil && *msg.EventSeqNumber < *e.FromSequence) ||
+			(e.ToSequence != nil && *msg.EventSeqNumber > *e.ToSequence) {
+			return false
+		}
+	}
+
+	if e.PropertyValue != "" && msg.Properties[currentConfig.IndexProperty] != e.PropertyValue {
+		return false
+	}
+
+	return true
+}
+
+// GetIndexRange returns the index that should be used to scan the export range, and the keys it's bounded by.
+// The partition index is the most selective, then the property index and then the time index.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ExportConfig.
+//
+// Returns:
+//  prefix of the index keys, first key and last key of the range (both inclusive).
+func (e ExportConfig) GetIndexRange() ([]byte, []byte, []byte) {
+	if source, partitionId := e.GetPartition(); partitionId != "" {
+		prefix := GetSequenceIndexPrefix(source, partitionId)
+		first, last := prefix, prefix+"\xff"
+		if e.FromSequence != nil {
+			first = fmt.Sprintf("%s%020d/", prefix, *e.FromSequence)
+		}
+		if e.ToSequence != nil {
+			last = fmt.Sprintf("%s%020d/\xff", prefix, *e.ToSequence)
+		}
+		return []byte(prefix), []byte(first), []byte(last)
+	}
+
+	if e.PropertyValue != "" {
+		prefix := GetPropertyIndexPrefix(e.PropertyValue)
+		return []byte(prefix), []byte(prefix), []byte(prefix + "\xff")
+	}
+
+	prefix := GetTimeIndexPrefix()
+	first, last := prefix, prefix+"\xff"
+	if !e.From.IsZero() {
+		first = fmt.Sprintf("%s%020d/", prefix, e.From.UnixNano())
+	}
+	if !e.To.IsZero() {
+		last = fmt.Sprintf("%s%020d/\xff", prefix, e.To.UnixNano())
+	}
+	return []byte(prefix), []byte(first), []byte(last)
+}
+
+// ForEachExportedMessage calls a function for every message in the export range, last ones first.
+// When a range is configured, an index is scanned instead of the whole database.
+//
+// Parameters:
+//  txn: badger transaction used to read.
+//  fn: function called with every message in the range. if it returns an error, the scan stops.
+//
+// Returns:
+//  error returned by badger or by fn.
+func ForEachExportedMessage(txn *badger.Txn, fn func(msg *Message) error) error {
+	if !currentConfig.Export.IsSet() {
+		return forEachMessage(txn, fn)
+	}
+
+	prefix, first, last := currentConfig.Export.GetIndexRange()
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Seek(last); iter.ValidForPrefix(prefix); iter.Next() {
+		if bytes.Compare(iter.Item().Key(), first) < 0 {
+			break
+		}
+
+		msgKey, err := iter.Item().ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		item, err := txn.Get(msgKey)
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = item.Value(func(val []byte) error {
+			msg := Deserialize(val)
+			if !currentConfig.Export.Matches(*msg) {
+				return nil
+			}
+			return fn(msg)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forEachMessage calls a function for every message in the database, last ones first.
+//
+// Parameters:
+//  txn: badger transaction used to read.
+//  fn: function called with every message. if it returns an error, the scan stops.
+//
+// Returns:
+//  error returned by badger or by fn.
+func forEachMessage(txn *badger.Txn, fn func(msg *Message) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		dbRow := iter.Item()
+		if IsReservedKey(dbRow.Key()) {
+			continue
+		}
+
+		err := dbRow.Value(func(val []byte) error {
+			return fn(Deserialize(val))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DescribeExportRange returns a description of the messages in the export range, to be logged.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  description of the export range.
+func DescribeExportRange() string {
+	e := currentConfig.Export
+	if !e.IsSet() {
+		return "all messages"
+	}
+
+	var bounds []string
+	if !e.From.IsZero() {
+		bounds = append(bounds, fmt.Sprintf("enqueued since '%s'", e.From.Format(time.RFC3339)))
+	}
+	if !e.To.IsZero() {
+		bounds = append(bounds, fmt.Sprintf("enqueued until '%s'", e.To.Format(time.RFC3339)))
+	}
+	if e.Partition != "" {
+		bounds = append(bounds, fmt.Sprintf("from partition '%s'", e.Partition))
+	}
+	if e.FromSequence != nil {
+		bounds = append(bounds, fmt.Sprintf("with sequence number >= %d", *e.FromSequence))
+	}
+	if e.ToSequence != nil {
+		bounds = append(bounds, fmt.Sprintf("with sequence number <= %d", *e.ToSequence))
+	}
+	if e.PropertyValue != "" {
+		bounds = append(bounds, fmt.Sprintf("with %s = '%s'", currentConfig.IndexProperty, e.PropertyValue))
+	}
+
+	return "messages " + strings.Join(bounds, ", ")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestGetIndexKeys checks the index keys of a Message, with and without 'indexProperty', and that messages without
+// enqueued time or sequence number are not indexed by them.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestGetIndexKeys(t *testing.T) {
+	defer func() { currentConfig = Config{} }()
+	seq := int64(7)
+	msg := Message{
+		Key:            "msg/orders/2/id/abc",
+		QueuedTime:     time.Unix(1600000000, 5),
+		EventSeqNumber: &seq,
+		PartitionId:    "2",
+		Source:         "orders",
+		Properties:     map[string]string{"tenant": "acme/eu"},
+	}
+	timeKey := "__hubtools__/idx/time/01600000000000000005/msg/orders/2/id/abc"
+	seqKey := "__hubtools__/idx/seq/orders/2/00000000000000000007/msg/orders/2/id/abc"
+
+	currentConfig = Config{}
+	checkIndexKeys(t, msg, timeKey, seqKey)
+	checkIndexKeys(t, Message{Key: msg.Key})
+
+	currentConfig.IndexProperty = "tenant"
+	checkIndexKeys(t, msg, timeKey, seqKey, "__hubtools__/idx/prop/tenant/acme%2Feu/msg/orders/2/id/abc")
+
+	currentConfig.IndexProperty = "region"
+	checkIndexKeys(t, msg, timeKey, seqKey)
+}
+
+// checkIndexKeys fails the test if the index keys of a Message are not the ones expected.
+//
+// Parameters:
+//  t: state of the test.
+//  msg: Message whose index keys are checked.
+//  want: expected index keys, in order.
+//
+// Returns:
+//  Nothing.
+func checkIndexKeys(t *testing.T, msg Message, want ...string) {
+	keys := GetIndexKeys(msg)
+	if len(keys) != len(want) {
+		t.Errorf("message has %d index keys with indexProperty '%s', want %d: %q",
+			len(keys), currentConfig.IndexProperty, len(want), keys)
+		return
+	}
+
+	for i, key := range keys {
+		if string(key) != want[i] {
+			t.Errorf("index key %d is '%s', want '%s'", i, key, want[i])
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// GetMessageKey returns the badger key of a Message, used to detect duplicates, built as configured in 'dedupKey'.
+// Keys are namespaced by source and partition: msg/<source>/<partition id>/<strategy>/<value>, so messages from
+// different sources or partitions never share a key. If the Message doesn't have the value used by the strategy
+// (no event id, or no property), its sequence number is used instead.
+//
+// Parameters:
+//  msg: Message that will be saved.
+//
+// Returns:
+//  badger key of the Message.
+func GetMessageKey(msg Message) string {
+	switch currentConfig.DedupKey {
+	case dedupKeyBodyHash:
+		hash := sha256.Sum256(msg.GetBody())
+		return buildMessageKey(msg, "body", hex.EncodeToString(hash[:]))
+
+	case dedupKeyProperty:
+		if value, found := msg.Properties[currentConfig.DedupKeyProperty]; found && value != "" {
+			return buildMessageKey(msg, "prop/"+currentConfig.DedupKeyProperty, value)
+		}
+
+	case dedupKeyPartitionSequence:
+		break
+
+	default:
+		if msg.EventId != "" {
+			return buildMessageKey(msg, "id", msg.EventId)
+		}
+	}
+
+	seq := "none"
+	if msg.EventSeqNumber != nil {
+		seq = fmt.Sprintf("%020d", *msg.EventSeqNumber)
+	}
+	return buildMessageKey(msg, "seq", seq)
+}
+
+// buildMessageKey joins the parts of a Message key.
+//
+// Parameters:
+//  msg: Message that will be saved.
+//  strategy: name of the strategy used to get the value.
+//  value: value that identifies the Message.
+//
+// Returns:
+//  badger key of the Message.
+func buildMessageKey(msg Message, strategy string, value string) string {
+	return fmt.Sprintf("%s%s/%s/%s/%s", messageKeyPrefix, msg.Source, msg.PartitionId, strategy, value)
+}
+
+// GetDumpMsgId returns the id used in the name of the file a Message is dumped to. That's the event id, when
+// there's one, or the Message key, with the characters that can't be used in filenames replaced.
+// When there's more than one source, the event id is prefixed with the name of the source.
+//
+// Parameters:
+//  msg: Message that will be dumped.
+//
+// Returns:
+//  id used in the filename.
+func GetDumpMsgId(msg Message) string {
+	if currentConfig.DedupKey == dedupKeyEventId && msg.EventId != "" {
+		if len(currentConfig.Sources) > 1 {
+			return fmt.Sprintf("%s_%s", msg.Source, msg.EventId)
+		}
+		return msg.EventId
+	}
+
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(strings.TrimPrefix(msg.Key, messageKeyPrefix))
+}
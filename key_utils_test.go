@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+// TestGetMessageKey checks the key of a Message with every 'dedupKey' strategy, and that the sequence number is used
+// when the Message doesn't have the value the strategy needs.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestGetMessageKey(t *testing.T) {
+	defer func() { currentConfig = Config{} }()
+	seq := int64(42)
+	msg := Message{
+		EventId:        "abc",
+		EventSeqNumber: &seq,
+		PartitionId:    "1",
+		Source:         "orders",
+		Properties:     map[string]string{"orderId": "o-7"},
+		Body:           []byte("hello"),
+	}
+	withoutValues := Message{EventSeqNumber: &seq, PartitionId: "1", Source: "orders"}
+
+	currentConfig = Config{DedupKeyProperty: "orderId"}
+	checkMessageKey(t, msg, "msg/orders/1/id/abc")
+	checkMessageKey(t, withoutValues, "msg/orders/1/seq/00000000000000000042")
+
+	currentConfig.DedupKey = dedupKeyPartitionSequence
+	checkMessageKey(t, msg, "msg/orders/1/seq/00000000000000000042")
+	checkMessageKey(t, Message{PartitionId: "1", Source: "orders"}, "msg/orders/1/seq/none")
+
+	currentConfig.DedupKey = dedupKeyProperty
+	checkMessageKey(t, msg, "msg/orders/1/prop/orderId/o-7")
+	checkMessageKey(t, withoutValues, "msg/orders/1/seq/00000000000000000042")
+
+	currentConfig.DedupKey = dedupKeyBodyHash
+	checkMessageKey(t, msg, "msg/orders/1/body/2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+}
+
+// checkMessageKey fails the test if the key of a Message is not the one expected.
+//
+// Parameters:
+//  t: state of the test.
+//  msg: Message whose key is checked.
+//  want: expected key.
+//
+// Returns:
+//  Nothing.
+func checkMessageKey(t *testing.T, msg Message, want string) {
+	if got := GetMessageKey(msg); got != want {
+		t.Errorf("key with dedupKey '%s' is %q, want %q", currentConfig.DedupKey, got, want)
+	}
+}
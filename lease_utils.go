@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewLeaseStore creates the LeaseStore configured in 'loadBalancing', for a source.
+// Leases are namespaced by env, source, entity path and consumer group, so different sources never share leases,
+// even if they read hubs with the same name from different namespaces.
+// Will panic in case of failure.
+//
+// Parameters:
+//  source: eventhub whose partitions are leased.
+//
+// Returns:
+//  new LeaseStore.
+func NewLeaseStore(source SourceConfig) LeaseStore {
+	switch currentConfig.LoadBalancing.LeaseStore {
+	case leaseStoreFile:
+		dir := filepath.Join(currentConfig.LoadBalancing.LeaseDir,
+			currentConfig.Env,
+			source.Name,
+			source.EntityPath,
+			strings.ReplaceAll(source.ConsumerGroup, "$", "_"))
+		EnsureDirExists(dir)
+		return &FileLeaseStore{dir: dir}
+	}
+
+	HandleError("Failed to create lease store.",
+		fmt.Errorf("lease store '%s' is not supported", currentConfig.LoadBalancing.LeaseStore),
+		true)
+	return nil
+}
+
+// List returns the lease of every partition that was ever leased.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  leases, by partition id, and error, if they could not be read.
+func (s *FileLeaseStore) List() (map[string]Lease, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make(map[string]Lease)
+	for _, f := range files {
+		lease, err := s.read(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		leases[lease.PartitionId] = lease
+	}
+
+	return leases, nil
+}
+
+// Acquire takes the lease of a partition, if nobody else owns it or the lease of its owner expired.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//  owner: name of the instance taking the lease.
+//  duration: how long the lease lasts, unless renewed.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  true if the lease was acquired, and error, if the lease could not be read or written.
+func (s *FileLeaseStore) Acquire(partitionId string, owner string, duration time.Duration) (bool, error) {
+	return s.update(partitionId, func(lease *Lease) bool {
+		if lease.Owner != "" && lease.Owner != owner && lease.ExpiresAt.After(time.Now()) {
+			return false
+		}
+		lease.Owner = owner
+		lease.ExpiresAt = time.Now().Add(duration)
+		return true
+	})
+}
+
+// Renew extends the lease of a partition, if it's still owned by the instance.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//  owner: name of the instance that owns the lease.
+//  duration: how long the lease lasts, from now, unless renewed again.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  false if the lease is now owned by another instance, and error, if the lease could not be read or written.
+func (s *FileLeaseStore) Renew(partitionId string, owner string, duration time.Duration) (bool, error) {
+	return s.update(partitionId, func(lease *Lease) bool {
+		if lease.Owner != owner {
+			return false
+		}
+		lease.ExpiresAt = time.Now().Add(duration)
+		return true
+	})
+}
+
+// Steal takes the lease of a partition from another instance, even if it did not expire.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//  owner: name of the instance taking the lease.
+//  duration: how long the lease lasts, unless renewed.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  true if the lease was taken, and error, if the lease could not be read or written.
+func (s *FileLeaseStore) Steal(partitionId string, owner string, duration time.Duration) (bool, error) {
+	return s.update(partitionId, func(lease *Lease) bool {
+		lease.Owner = owner
+		lease.ExpiresAt = time.Now().Add(duration)
+		return true
+	})
+}
+
+// Release gives up the lease of a partition, so other instances can take it right away.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//  owner: name of the instance that owns the lease.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  error, if the lease could not be read or written.
+func (s *FileLeaseStore) Release(partitionId string, owner string) error {
+	_, err := s.update(partitionId, func(lease *Lease) bool {
+		if lease.Owner != owner {
+			return false
+		}
+		lease.Owner = ""
+		lease.ExpiresAt = time.Time{}
+		return true
+	})
+	return err
+}
+
+// SaveCheckpoint stores the checkpoint of a partition, if it's still owned by the instance. This way, an instance
+// that lost a partition never moves its checkpoint.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//  owner: name of the instance that owns the lease.
+//  checkpoint: position of the last message processed.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  false if the lease is owned by another instance, and error, if the lease could not be read or written.
+func (s *FileLeaseStore) SaveCheckpoint(partitionId string, owner string, checkpoint persist.Checkpoint) (bool, error) {
+	return s.update(partitionId, func(lease *Lease) bool {
+		if lease.Owner != owner {
+			return false
+		}
+		lease.Checkpoint = &checkpoint
+		return true
+	})
+}
+
+// LoadCheckpoint returns the checkpoint of a partition.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  checkpoint (nil if there's none) and error, if the lease could not be read.
+func (s *FileLeaseStore) LoadCheckpoint(partitionId string) (*persist.Checkpoint, error) {
+	lease, err := s.read(partitionId)
+	return lease.Checkpoint, err
+}
+
+// update changes the lease of a partition while holding its lock, so instances don't overwrite each other.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//  change: changes the lease. if it returns false, nothing is written.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  the result of change, and error, if the lease could not be read or written.
+func (s *FileLeaseStore) update(partitionId string, change func(lease *Lease) bool) (bool, error) {
+	unlock, err := s.lock(partitionId)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	lease, err := s.read(partitionId)
+	if err != nil || !change(&lease) {
+		return false, err
+	}
+
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+
+	tmp := s.path(partitionId, ".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return false, err
+	}
+
+	return true, os.Rename(tmp, s.path(partitionId, ".json"))
+}
+
+// read loads the lease of a partition.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  lease (empty if the partition was never leased) and error, if the lease could not be read.
+func (s *FileLeaseStore) read(partitionId string) (Lease, error) {
+	lease := Lease{PartitionId: partitionId}
+
+	data, err := ioutil.ReadFile(s.path(partitionId, ".json"))
+	if os.IsNotExist(err) {
+		return lease, nil
+	}
+	if err != nil {
+		return lease, err
+	}
+
+	err = json.Unmarshal(data, &lease)
+	return lease, err
+}
+
+// lock creates the lock file of a partition, waiting while another instance holds it. Lock files older than
+// 10 seconds are considered abandoned (an instance that crashed) and removed.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  function that releases the lock, and error, if the lock could not be taken.
+func (s *FileLeaseStore) lock(partitionId string) (func(), error) {
+	lockFile := s.path(partitionId, ".lock")
+
+	for attempt := 0; attempt < 250; attempt++ {
+		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(lockFile) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(lockFile); err == nil && time.Since(fi.ModTime()) > 10*time.Second {
+			_ = os.Remove(lockFile)
+			continue
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return nil, fmt.Errorf("timed out waiting for lock '%s'", lockFile)
+}
+
+// path returns the path of a file of a partition.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//  ext: extension of the file.
+//
+// Receiver:
+//  Instance of FileLeaseStore.
+//
+// Returns:
+//  path of the file.
+func (s *FileLeaseStore) path(partitionId string, ext string) string {
+	return filepath.Join(s.dir, partitionId+ext)
+}
+
+// NewPartitionBalancer creates a PartitionBalancer.
+//
+// Parameters:
+//  source: name of the source whose partitions are balanced.
+//  store: lease store shared by every instance.
+//  partitions: partitions that will be spread among the instances.
+//  start: starts receiving messages from a partition, until the context is cancelled.
+//
+// Returns:
+//  new instance of PartitionBalancer.
+func NewPartitionBalancer(source string, store LeaseStore, partitions []string, start func(ctx context.Context, partitionId string) error) *PartitionBalancer {
+	return &PartitionBalancer{
+		source:     source,
+		store:      store,
+		owner:      currentConfig.LoadBalancing.InstanceName,
+		duration:   partitionLeaseDuration,
+		partitions: partitions,
+		start:      start,
+		owned:      make(map[string]context.CancelFunc),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// Run balances the partitions right away and then 3 times per lease duration, until the context is cancelled.
+// Receivers of the partitions owned are started with a context derived from the one passed.
+//
+// Parameters:
+//  ctx: context of the read operation.
+//
+// Receiver:
+//  Instance of PartitionBalancer.
+//
+// Returns:
+//  Nothing.
+func (b *PartitionBalancer) Run(ctx context.Context) {
+	defer close(b.stopped)
+	ticker := time.NewTicker(b.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		b.balance(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// balance renews the leases owned, and takes free leases, or leases of instances with too many of them, until this
+// instance has its share of the partitions.
+//
+// Parameters:
+//  ctx: context of the read operation.
+//
+// Receiver:
+//  Instance of PartitionBalancer.
+//
+// Returns:
+//  Nothing.
+func (b *PartitionBalancer) balance(ctx context.Context) {
+	for _, partitionId := range b.Owned() {
+		renewed, err := b.store.Renew(partitionId, b.owner, b.duration)
+		if err != nil {
+			log.Printf("[ERROR] Failed to renew lease of partition '%s' of '%s'. Details: %s\n",
+				partitionId, b.source, err)
+			continue
+		}
+		if !renewed {
+			log.Printf("Lease of partition '%s' of '%s' was taken by another instance.\n", partitionId, b.source)
+			b.stop(partitionId)
+		}
+	}
+
+	leases, err := b.store.List()
+	if err != nil {
+		log.Printf("[ERROR] Failed to list partition leases of '%s'. Details: %s\n", b.source, err)
+		return
+	}
+
+	owned := len(b.Owned())
+	counts := map[string]int{b.owner: owned}
+	for _, partitionId := range b.partitions {
+		lease := leases[partitionId]
+		if lease.Owner != "" && lease.Owner != b.owner && lease.ExpiresAt.After(time.Now()) {
+			counts[lease.Owner]++
+		}
+	}
+
+	target := (len(b.partitions) + len(counts) - 1) / len(counts)
+	for _, partitionId := range b.partitions {
+		if owned >= target || ctx.Err() != nil {
+			break
+		}
+
+		lease := leases[partitionId]
+		if b.isOwned(partitionId) || (lease.Owner != "" && lease.ExpiresAt.After(time.Now())) {
+			continue
+		}
+
+		if acquired, err := b.store.Acquire(partitionId, b.owner, b.duration); err == nil && acquired {
+			b.begin(ctx, partitionId)
+			owned++
+		}
+	}
+
+	if owned >= len(b.partitions)/len(counts) || ctx.Err() != nil {
+		return
+	}
+
+	victim := ""
+	for owner, count := range counts {
+		if owner != b.owner && count > owned+1 && (victim == "" || count > counts[victim]) {
+			victim = owner
+		}
+	}
+	for _, partitionId := range b.partitions {
+		if victim == "" || leases[partitionId].Owner != victim {
+			continue
+		}
+
+		if stolen, err := b.store.Steal(partitionId, b.owner, b.duration); err == nil && stolen {
+			log.Printf("Took partition '%s' of '%s' from instance '%s'.\n", partitionId, b.source, victim)
+			b.begin(ctx, partitionId)
+		}
+		return
+	}
+}
+
+// begin starts receiving messages from a partition whose lease was acquired. If the receiver fails to start, the
+// lease is released.
+//
+// Parameters:
+//  ctx: context of the read operation.
+//  partitionId: id of the partition.
+//
+// Receiver:
+//  Instance of PartitionBalancer.
+//
+// Returns:
+//  Nothing.
+func (b *PartitionBalancer) begin(ctx context.Context, partitionId string) {
+	partitionCtx, cancel := context.WithCancel(ctx)
+	if err := b.start(partitionCtx, partitionId); err != nil {
+		cancel()
+		log.Printf("[ERROR] Failed to start receiving messages from partition '%s' of '%s'. Details: %s\n",
+			partitionId, b.source, err)
+		_ = b.store.Release(partitionId, b.owner)
+		return
+	}
+
+	b.mu.Lock()
+	b.owned[partitionId] = cancel
+	b.mu.Unlock()
+
+	log.Printf("Acquired lease of partition '%s' of '%s'.\n", partitionId, b.source)
+	DescribeReadProgress()
+}
+
+// stop stops receiving messages from a partition.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//
+// Receiver:
+//  Instance of PartitionBalancer.
+//
+// Returns:
+//  Nothing.
+func (b *PartitionBalancer) stop(partitionId string) {
+	b.mu.Lock()
+	cancel, found := b.owned[partitionId]
+	delete(b.owned, partitionId)
+	b.mu.Unlock()
+
+	if found {
+		cancel()
+		DescribeReadProgress()
+	}
+}
+
+// isOwned checks if this instance owns the lease of a partition.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//
+// Receiver:
+//  Instance of PartitionBalancer.
+//
+// Returns:
+//  true if the partition is owned. false otherwise.
+func (b *PartitionBalancer) isOwned(partitionId string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, found := b.owned[partitionId]
+	return found
+}
+
+// Owned returns the partitions this instance owns, sorted.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of PartitionBalancer.
+//
+// Returns:
+//  ids of the partitions owned.
+func (b *PartitionBalancer) Owned() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	owned := make([]string, 0, len(b.owned))
+	for partitionId := range b.owned {
+		owned = append(owned, partitionId)
+	}
+	sort.Strings(owned)
+	return owned
+}
+
+// SaveCheckpoint stores the position of a processed Message in the lease store, if its partition is still owned.
+// Failures are logged, since the checkpoint is also saved to the database.
+//
+// Parameters:
+//  msg: last Message processed from a partition.
+//
+// Receiver:
+//  Instance of PartitionBalancer.
+//
+// Returns:
+//  Nothing.
+func (b *PartitionBalancer) SaveCheckpoint(msg Message) {
+	if msg.PartitionId == "" || msg.EventOffset == nil || msg.EventSeqNumber == nil {
+		return
+	}
+
+	checkpoint := persist.NewCheckpoint(
+		strconv.FormatInt(*msg.EventOffset, 10),
+		*msg.EventSeqNumber,
+		msg.QueuedTime)
+	if _, err := b.store.SaveCheckpoint(msg.PartitionId, b.owner, checkpoint); err != nil {
+		log.Printf("[ERROR] Failed to save checkpoint of partition '%s' of '%s' to lease store. Details: %s\n",
+			msg.PartitionId, b.source, err)
+	}
+}
+
+// LoadCheckpoint returns the checkpoint of a partition saved in the lease store.
+//
+// Parameters:
+//  partitionId: id of the partition.
+//
+// Receiver:
+//  Instance of PartitionBalancer.
+//
+// Returns:
+//  checkpoint. nil if there's none, or it could not be loaded.
+func (b *PartitionBalancer) LoadCheckpoint(partitionId string) *persist.Checkpoint {
+	checkpoint, err := b.store.LoadCheckpoint(partitionId)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load checkpoint of partition '%s' of '%s' from lease store. Details: %s\n",
+			partitionId, b.source, err)
+		return nil
+	}
+
+	return checkpoint
+}
+
+// Close waits for Run to return and releases every lease owned, so other instances can take the partitions right
+// away. Must be called after the context passed to Run is cancelled and the checkpoints are saved.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of PartitionBalancer.
+//
+// Returns:
+//  Nothing.
+func (b *PartitionBalancer) Close() {
+	<-b.stopped
+	for _, partitionId := range b.Owned() {
+		b.stop(partitionId)
+		if err := b.store.Release(partitionId, b.owner); err != nil {
+			log.Printf("[ERROR] Failed to release lease of partition '%s' of '%s'. Details: %s\n",
+				partitionId, b.source, err)
+		}
+	}
+}
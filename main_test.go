@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteReadAndExportToFile sends files to an in-memory eventhub, reads them into the database and exports them.
+func TestWriteReadAndExportToFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestRunConfig(dir, "")
+	defer resetMemoryHubs()
+
+	writeTestFiles(t, filepath.Join(dir, "outbound"), 3)
+	setUpTestRun(t, "write", cfg)
+	sendToEventhub()
+
+	setUpTestRun(t, "read", cfg)
+	readEventHubMessages()
+	if readStats.Stored != 7 {
+		t.Fatalf("read stored %d messages, want 7 (4 initial and 3 sent)", readStats.Stored)
+	}
+
+	setUpTestRun(t, "read", cfg)
+	readEventHubMessages()
+	if readStats.Processed != 0 {
+		t.Fatalf("second read processed %d messages, want 0", readStats.Processed)
+	}
+
+	setUpTestRun(t, "export2file", cfg)
+	exportToFile()
+	if files := countFiles(t, filepath.Join(dir, "dump")); files != 7 {
+		t.Fatalf("export2file wrote %d files, want 7", files)
+	}
+}
+
+// TestWriteAndReadFromMemoryHubDir sends files to an in-memory eventhub saved to a directory, and reads them in a
+// later run.
+func TestWriteAndReadFromMemoryHubDir(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestRunConfig(dir, filepath.Join(dir, "memoryHub"))
+	defer resetMemoryHubs()
+
+	writeTestFiles(t, filepath.Join(dir, "outbound"), 3)
+	setUpTestRun(t, "write", cfg)
+	sendToEventhub()
+
+	// A new run doesn't share the in-memory eventhub of the previous one.
+	resetMemoryHubs()
+	setUpTestRun(t, "read", cfg)
+	readEventHubMessages()
+	if readStats.Stored != 7 {
+		t.Fatalf("read stored %d messages, want 7 (4 initial and 3 sent)", readStats.Stored)
+	}
+}
+
+// newTestRunConfig returns the configuration of an in-memory eventhub with 2 partitions and 2 initial messages in
+// each, with every directory inside dir.
+func newTestRunConfig(dir string, memoryHubDir string) map[string]interface{} {
+	return map[string]interface{}{
+		"env":                "test",
+		"entityPath":         "demo",
+		"consumerGroup":      "$Default",
+		"transport":          transportMemory,
+		"untilCaughtUp":      true,
+		"badgerBase":         filepath.Join(dir, "db"),
+		"badgerDir":          filepath.Join(dir, "db", "dir"),
+		"badgerValueDir":     filepath.Join(dir, "db", "val"),
+		"messageDumpDir":     filepath.Join(dir, "dump"),
+		"outboundFolder":     filepath.Join(dir, "outbound"),
+		"outboundFolderSent": filepath.Join(dir, "sent"),
+		"memoryHub": map[string]interface{}{
+			"partitions":      2,
+			"initialMessages": 2,
+			"dir":             memoryHubDir,
+		},
+	}
+}
+
+// setUpTestRun resets the state left by the previous operation, then loads and validates a configuration, like
+// PrepareToRun does.
+func setUpTestRun(t *testing.T, op string, cfg map[string]interface{}) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	CloseConnection()
+	currentConfig = Config{}
+	cmdArgs = CommandLineArgs{}
+	dumpPool = nil
+	messageFilter = nil
+	leaseBalancers = make(map[string]*PartitionBalancer)
+	LoadConfig(path)
+	ValidateRunConfiguration(path, op)
+}
+
+// resetMemoryHubs forgets the in-memory eventhubs, like a new run does.
+func resetMemoryHubs() {
+	memoryHubsMu.Lock()
+	defer memoryHubsMu.Unlock()
+	memoryHubs = make(map[string]*memoryHub)
+}
+
+// writeTestFiles writes count JSON files to a folder.
+func writeTestFiles(t *testing.T, dir string, count int) {
+	EnsureDirExists(dir)
+	for i := 0; i < count; i++ {
+		data := []byte(fmt.Sprintf(`{"file": %d}`, i))
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d.json", i)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// countFiles counts the files in a directory and its subdirectories.
+func countFiles(t *testing.T, dir string) int {
+	files := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,25 +28,91 @@ import (
 func (m *Message) ToString() string {
 	str := fmt.Sprintf(`---| DETAILS      |-----------------------------------------------------
 id: %s
+source: %s
+content type: %s
 added to queue at: %s
 event sequence number: %s
 event offset: %s
+partition id: %s
+partition key: %s
+schema validation: %s
 Message processed at: %s
 processing elapsed time: %s
 
+---| PROPERTIES   |-----------------------------------------------------
+%s
+---| SYSTEM PROPS |-----------------------------------------------------
+%s
 ---| MESSAGE BODY |-----------------------------------------------------
 %s`,
 		m.EventId,
+		m.Source,
+		m.DescribeContentType(),
 		m.QueuedTime.Format(time.RFC3339Nano),
 		strconv.FormatInt(*m.EventSeqNumber, 10),
 		strconv.FormatInt(*m.EventOffset, 10),
+		m.PartitionId,
+		m.PartitionKey,
+		m.ValidationStatus,
 		m.ProcessedAt.Format(time.RFC3339Nano),
 		m.ElapsedTime,
-		m.MsgData)
+		PropertiesToString(m.Properties),
+		PropertiesToString(m.SystemProperties),
+		m.BodyToString())
 
 	return str
 }
 
+// PropertiesToString converts a map of properties to string, one property per line, sorted by name.
+//
+// Parameters:
+//  props: properties that will be converted.
+//
+// Returns:
+//  string representation of the properties.
+func PropertiesToString(props map[string]string) string {
+	var keys []string
+	for key := range props {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, key := range keys {
+		sb.WriteString(fmt.Sprintf("%s: %s\n", key, props[key]))
+	}
+
+	return sb.String()
+}
+
+// StringifyProperties converts the values of event properties (application or system) to string, so they
+// can be serialized and displayed regardless of the type used by the producer.
+//
+// Parameters:
+//  props: properties that will be converted.
+//
+// Returns:
+//  map with the string representation of each property. nil if there are no properties.
+func StringifyProperties(props map[string]interface{}) map[string]string {
+	if len(props) == 0 {
+		return nil
+	}
+
+	values := make(map[string]string, len(props))
+	for key, value := range props {
+		switch v := value.(type) {
+		case time.Time:
+			values[key] = v.Format(time.RFC3339Nano)
+		case []byte:
+			values[key] = string(v)
+		default:
+			values[key] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	return values
+}
+
 // ParseCommandLine parses the command line.
 // Will panic in case of failure.
 //
@@ -55,10 +124,65 @@ processing elapsed time: %s
 func ParseCommandLine() (string, string) {
 	generalCmd := flag.NewFlagSet("general", flag.ExitOnError)
 	readCmdPtr := generalCmd.String("Config", defaultConfigFile, "Which Config file to use.")
+	partitionsPtr := generalCmd.String("partitions", "",
+		"Comma separated list of partition ids to read from. (default: all partitions)")
+	startPositionPtr := generalCmd.String("start-position", "",
+		"Where to start reading: checkpoint|earliest|latest|enqueued-time|sequence-number. (default: checkpoint)")
+	startEnqueuedTimePtr := generalCmd.String("start-enqueued-time", "",
+		"RFC3339 timestamp used when start-position is enqueued-time.")
+	startSequenceNumberPtr := generalCmd.String("start-sequence-number", "",
+		"Sequence number used when start-position is sequence-number.")
+	maxMessagesPtr := generalCmd.String("max-messages", "",
+		"Stops reading after processing this many messages.")
+	maxDurationPtr := generalCmd.String("max-duration", "",
+		"Stops reading after this duration. (e.g.: 90s, 15m, 2h)")
+	untilCaughtUpPtr := generalCmd.Bool("until-caught-up", false,
+		"Stops reading when every partition reaches the last message it had when reading started.")
+	benchmarkMessagesPtr := generalCmd.String("benchmark-messages", "",
+		"Number of fake messages used by the benchmark operation.")
+	tailFormatPtr := generalCmd.String("tail-format", "",
+		"How the tail operation prints messages: details|line|jsonl. (default: line)")
+	contentEncodingPtr := generalCmd.String("content-encoding", "",
+		"Compression used by the write operation for the files it sends: gzip|deflate|zstd. (default: none)")
+	prettyJsonPtr := generalCmd.Bool("pretty-json", false,
+		"Indents JSON payloads printed by the tail operation.")
+	colorPtr := generalCmd.Bool("color", false,
+		"Uses colors in the output of the tail operation.")
+	capturePartitionPtr := generalCmd.String("capture-partition", "",
+		"Partition id of the Capture files whose path doesn't follow the default Capture naming.")
+	captureDirPtr := generalCmd.String("capture-dir", "",
+		"Directory with the Capture Avro files imported by the import-capture operation.")
+	validationReportPtr := generalCmd.String("validation-report", "",
+		"File where the validate operation writes its report.")
+	exportFromPtr := generalCmd.String("export-from", "",
+		"Exports only messages enqueued at or after this time (RFC3339).")
+	exportToPtr := generalCmd.String("export-to", "",
+		"Exports only messages enqueued at or before this time (RFC3339).")
+	exportPartitionPtr := generalCmd.String("export-partition", "",
+		"Exports only messages of this partition (<partition id> or <source>/<partition id>).")
+	exportFromSequencePtr := generalCmd.String("export-from-sequence", "",
+		"Exports only messages with this sequence number or greater. Requires export-partition.")
+	exportToSequencePtr := generalCmd.String("export-to-sequence", "",
+		"Exports only messages with this sequence number or lower. Requires export-partition.")
+	exportPropertyPtr := generalCmd.String("export-property", "",
+		"Exports only messages whose indexed property (see indexProperty) has this value.")
+	newKeyFilePtr := generalCmd.String("new-key-file", "",
+		"File with the new encryption key used by the rotate-key operation.")
+	decryptPathPtr := generalCmd.String("decrypt-path", "",
+		"Encrypted file, or directory with encrypted files, decrypted by the decrypt operation.")
+	decryptOutputPtr := generalCmd.String("decrypt-output", "",
+		"Directory where the decrypt operation writes the decrypted files. Default: next to the encrypted ones.")
+	backupFilePtr := generalCmd.String("backup-file", "",
+		"File written by the backup operation and read by the restore operation.")
+	sinceVersionPtr := generalCmd.String("since-version", "",
+		"Backs up only entries saved with this version or later (nextSinceVersion of the previous backup). Default: 0 (full).")
+	filterPtr := generalCmd.String("filter", "",
+		"Only messages matching this expression are saved. e.g.: \"prop.eventType == order && partition == 3\"")
 
 	if len(os.Args) < 2 {
 		generalCmd.Usage = func() { // [1]
-			_, err := fmt.Fprintf(flag.CommandLine.Output(), "usage: %s read|export2file [-Config=<Config file>]\n", os.Args[0])
+			_, err := fmt.Fprintf(flag.CommandLine.Output(), "usage: %s %s [-Config=<Config file>]\n",
+				os.Args[0], strings.Join(supportedOperations, "|"))
 			HandleError("Error printing command line usage", err, true)
 			generalCmd.PrintDefaults()
 		}
@@ -71,7 +195,7 @@ func ParseCommandLine() (string, string) {
 	var err error
 	var configFile string
 
-	if verb != "read" && verb != "export2file" && verb != "write" {
+	if !Contains(supportedOperations, verb) {
 		flag.PrintDefaults()
 		exitCode = 0
 		runtime.Goexit()
@@ -80,6 +204,33 @@ func ParseCommandLine() (string, string) {
 	err = generalCmd.Parse(os.Args[2:])
 	HandleError(fmt.Sprintf("Failed to parse '%s' command line", verb), err, true)
 	configFile = *readCmdPtr
+	cmdArgs.Partitions = *partitionsPtr
+	cmdArgs.StartPosition = *startPositionPtr
+	cmdArgs.StartEnqueuedTime = *startEnqueuedTimePtr
+	cmdArgs.StartSequenceNumber = *startSequenceNumberPtr
+	cmdArgs.MaxMessages = *maxMessagesPtr
+	cmdArgs.MaxDuration = *maxDurationPtr
+	cmdArgs.UntilCaughtUp = *untilCaughtUpPtr
+	cmdArgs.BenchmarkMessages = *benchmarkMessagesPtr
+	cmdArgs.Filter = *filterPtr
+	cmdArgs.TailFormat = *tailFormatPtr
+	cmdArgs.ContentEncoding = *contentEncodingPtr
+	cmdArgs.PrettyJson = *prettyJsonPtr
+	cmdArgs.Color = *colorPtr
+	cmdArgs.CaptureDir = *captureDirPtr
+	cmdArgs.CapturePartition = *capturePartitionPtr
+	cmdArgs.ValidationReport = *validationReportPtr
+	cmdArgs.ExportFrom = *exportFromPtr
+	cmdArgs.ExportTo = *exportToPtr
+	cmdArgs.ExportPartition = *exportPartitionPtr
+	cmdArgs.ExportFromSequence = *exportFromSequencePtr
+	cmdArgs.ExportToSequence = *exportToSequencePtr
+	cmdArgs.ExportProperty = *exportPropertyPtr
+	cmdArgs.NewKeyFile = *newKeyFilePtr
+	cmdArgs.DecryptPath = *decryptPathPtr
+	cmdArgs.DecryptOutput = *decryptOutputPtr
+	cmdArgs.BackupFile = *backupFilePtr
+	cmdArgs.SinceVersion = *sinceVersionPtr
 
 	if configFile == defaultConfigFile {
 		configFile = filepath.Join(GetAppDir(), configFile)
@@ -88,7 +239,166 @@ func ParseCommandLine() (string, string) {
 	return verb, configFile
 }
 
+// ApplyCommandLineArgs overrides the values loaded from the configuration file with the ones passed via command line.
+// Will panic in case of failure.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  Nothing.
+func ApplyCommandLineArgs() {
+	if cmdArgs.Partitions != "" {
+		currentConfig.Partitions = ParseCsvList(cmdArgs.Partitions)
+	}
+
+	if cmdArgs.StartPosition != "" {
+		currentConfig.StartPosition = cmdArgs.StartPosition
+	}
+
+	if cmdArgs.StartEnqueuedTime != "" {
+		ts, err := time.Parse(time.RFC3339, cmdArgs.StartEnqueuedTime)
+		HandleError("Failed to parse argument 'start-enqueued-time'", err, true)
+		currentConfig.StartEnqueuedTime = ts
+	}
+
+	if cmdArgs.StartSequenceNumber != "" {
+		seq, err := strconv.ParseInt(cmdArgs.StartSequenceNumber, 10, 64)
+		HandleError("Failed to parse argument 'start-sequence-number'", err, true)
+		currentConfig.StartSequenceNumber = seq
+	}
+
+	if cmdArgs.MaxMessages != "" {
+		maxMessages, err := strconv.ParseInt(cmdArgs.MaxMessages, 10, 64)
+		HandleError("Failed to parse argument 'max-messages'", err, true)
+		currentConfig.MaxMessages = maxMessages
+	}
+
+	if cmdArgs.MaxDuration != "" {
+		currentConfig.MaxDuration = cmdArgs.MaxDuration
+	}
+
+	if cmdArgs.UntilCaughtUp {
+		currentConfig.UntilCaughtUp = true
+	}
+
+	if cmdArgs.BenchmarkMessages != "" {
+		count, err := strconv.Atoi(cmdArgs.BenchmarkMessages)
+		HandleError("Failed to parse argument 'benchmark-messages'", err, true)
+		currentConfig.BenchmarkMessages = count
+	}
+
+	if cmdArgs.Filter != "" {
+		currentConfig.Filter = cmdArgs.Filter
+	}
+
+	if cmdArgs.TailFormat != "" {
+		currentConfig.TailFormat = cmdArgs.TailFormat
+	}
+
+	if cmdArgs.ContentEncoding != "" {
+		currentConfig.OutboundContentEncoding = cmdArgs.ContentEncoding
+	}
+
+	if cmdArgs.PrettyJson {
+		currentConfig.TailPrettyJson = true
+	}
+
+	if cmdArgs.Color {
+		currentConfig.TailColor = true
+	}
+
+	if cmdArgs.CaptureDir != "" {
+		currentConfig.CaptureDir = cmdArgs.CaptureDir
+	}
+
+	if cmdArgs.CapturePartition != "" {
+		currentConfig.CapturePartition = cmdArgs.CapturePartition
+	}
+
+	if cmdArgs.ValidationReport != "" {
+		currentConfig.ValidationReport = cmdArgs.ValidationReport
+	}
+
+	if cmdArgs.ExportFrom != "" {
+		ts, err := time.Parse(time.RFC3339, cmdArgs.ExportFrom)
+		HandleError("Failed to parse argument 'export-from'", err, true)
+		currentConfig.Export.From = ts
+	}
+
+	if cmdArgs.ExportTo != "" {
+		ts, err := time.Parse(time.RFC3339, cmdArgs.ExportTo)
+		HandleError("Failed to parse argument 'export-to'", err, true)
+		currentConfig.Export.To = ts
+	}
+
+	if cmdArgs.ExportPartition != "" {
+		currentConfig.Export.Partition = cmdArgs.ExportPartition
+	}
+
+	if cmdArgs.ExportFromSequence != "" {
+		seq, err := strconv.ParseInt(cmdArgs.ExportFromSequence, 10, 64)
+		HandleError("Failed to parse argument 'export-from-sequence'", err, true)
+		currentConfig.Export.FromSequence = &seq
+	}
+
+	if cmdArgs.ExportToSequence != "" {
+		seq, err := strconv.ParseInt(cmdArgs.ExportToSequence, 10, 64)
+		HandleError("Failed to parse argument 'export-to-sequence'", err, true)
+		currentConfig.Export.ToSequence = &seq
+	}
+
+	if cmdArgs.ExportProperty != "" {
+		currentConfig.Export.PropertyValue = cmdArgs.ExportProperty
+	}
+
+	if cmdArgs.NewKeyFile != "" {
+		currentConfig.Encryption.NewKeyFile = cmdArgs.NewKeyFile
+		currentConfig.Encryption.NewKeyEnv = ""
+	}
+
+	if cmdArgs.DecryptPath != "" {
+		currentConfig.Encryption.DecryptPath = cmdArgs.DecryptPath
+	}
+
+	if cmdArgs.DecryptOutput != "" {
+		currentConfig.Encryption.DecryptOutput = cmdArgs.DecryptOutput
+	}
+
+	if cmdArgs.BackupFile != "" {
+		currentConfig.Backup.File = cmdArgs.BackupFile
+	}
+
+	if cmdArgs.SinceVersion != "" {
+		since, err := strconv.ParseUint(cmdArgs.SinceVersion, 10, 64)
+		HandleError("Failed to parse argument 'since-version'", err, true)
+		currentConfig.Backup.SinceVersion = since
+	}
+}
+
+// ParseCsvList splits a comma separated list of values, trimming spaces and ignoring empty entries.
+//
+// Parameters:
+//  csv: comma separated list of values.
+//
+// Returns:
+//  slice with every value found in the list.
+func ParseCsvList(csv string) []string {
+	var values []string
+	for _, value := range strings.Split(csv, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		values = append(values, value)
+	}
+
+	return values
+}
+
 // Serialize converts a Message to byte[] so it can be saved to badgerDb.
+// Values start with a header (see GetStorageHeader) followed by the Message encoded as JSON. The payload is compressed
+// if 'storageCompression' is set.
 // Will panic in case of failure.
 //
 // Parameters:
@@ -100,15 +410,17 @@ func ParseCommandLine() (string, string) {
 // Returns:
 //  slice of bytes representing a instance of Message.
 func (m *Message) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-	err := encoder.Encode(m)
+	stored := *m
+	CompressStoredBody(&stored)
+
+	data, err := json.Marshal(stored)
 	HandleError("Failed to Serialize Message.", err, true)
 
-	return res.Bytes()
+	return append(GetStorageHeader(storageFormatVersion), data...)
 }
 
-// Deserialize Message object returned from badgerDb
+// Deserialize Message object returned from badgerDb.
+// Values saved by older versions, encoded with gob and without header, are still read.
 // Will panic in case of failure.
 //
 // Parameters:
@@ -119,10 +431,30 @@ func (m *Message) Serialize() []byte {
 func Deserialize(data []byte) *Message {
 	var m Message
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&m)
+	version, payload := GetStorageFormat(data)
+	switch version {
+	case storageFormatJson, storageFormatVersion:
+		err := json.Unmarshal(payload, &m)
+		HandleError("Failed to Deserialize Message.", err, true)
+		HandleError("Failed to decompress Message payload.", DecompressStoredBody(&m), true)
+
+	case storageFormatGob:
+		err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&m)
+		HandleError("Failed to Deserialize Message.", err, true)
+
+		// gob doesn't send zero values, so a sequence number or offset of 0 comes back as nil.
+		if m.EventSeqNumber == nil {
+			m.EventSeqNumber = new(int64)
+		}
+		if m.EventOffset == nil {
+			m.EventOffset = new(int64)
+		}
 
-	HandleError("Failed to Deserialize Message.", err, true)
+	default:
+		HandleError("Failed to Deserialize Message.",
+			fmt.Errorf("storage format version %d is not supported. it was written by a newer version", version),
+			true)
+	}
 
 	return &m
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// GetBody returns the raw payload of the Message.
+// Messages saved by older versions only have the payload as string, so it's used as fallback.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of Message.
+//
+// Returns:
+//  raw payload of the Message.
+func (m *Message) GetBody() []byte {
+	if m.Body != nil {
+		return m.Body
+	}
+
+	return []byte(m.MsgData)
+}
+
+// IsBinary checks if the payload of the Message can't be displayed as text.
+// Compressed payloads are checked after being decompressed.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of Message.
+//
+// Returns:
+//  true if the payload is binary. false if it's text.
+func (m *Message) IsBinary() bool {
+	if decoded, _ := m.DecodeProtobuf(); decoded != nil {
+		return false
+	}
+
+	contentType := m.GetDisplayContentType()
+	if contentType == "" {
+		body, _ := m.GetUncompressedBody()
+		return !utf8.Valid(body)
+	}
+
+	return !IsTextContentType(contentType)
+}
+
+// BodyToString returns a printable representation of the payload of the Message.
+// Compressed payloads are decompressed and protobuf payloads are decoded to JSON (see GetDisplayBody). Other binary
+// payloads are encoded as base64.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of Message.
+//
+// Returns:
+//  printable representation of the payload.
+func (m *Message) BodyToString() string {
+	if m.IsBinary() {
+		body, _ := m.GetUncompressedBody()
+		return base64.StdEncoding.EncodeToString(body)
+	}
+
+	return string(m.GetDisplayBody())
+}
+
+// GetDisplayBody returns the payload of the Message as it should be displayed. Compressed payloads are decompressed
+// and, when a protobuf descriptor set is configured, protobuf payloads are decoded to JSON. The raw payload is never
+// changed.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of Message.
+//
+// Returns:
+//  payload that should be displayed.
+func (m *Message) GetDisplayBody() []byte {
+	if decoded, _ := m.DecodeProtobuf(); decoded != nil {
+		return decoded
+	}
+
+	body, _ := m.GetUncompressedBody()
+	return body
+}
+
+// GetDisplayContentType returns the content type of the payload as it's displayed. When a compressed payload was
+// received without a text content type, the content type is detected again after decompressing it.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of Message.
+//
+// Returns:
+//  content type of the displayed payload.
+func (m *Message) GetDisplayContentType() string {
+	body, encoding := m.GetUncompressedBody()
+	if encoding != "" && !IsTextContentType(m.ContentType) {
+		return DetectContentType(body)
+	}
+
+	return m.ContentType
+}
+
+// DecodeProtobuf decodes the payload of the Message (decompressed, if needed) with the configured protobuf message
+// type.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of Message.
+//
+// Returns:
+//  JSON representation of the payload and the name of its message type. nil and empty if it was not decoded.
+func (m *Message) DecodeProtobuf() ([]byte, string) {
+	if protobufDecoder == nil || IsTextContentType(m.GetDisplayContentType()) {
+		return nil, ""
+	}
+
+	return protobufDecoder.Decode(*m)
+}
+
+// DescribeContentType returns the content type of the displayed payload, with the compression it was decompressed
+// from and the protobuf message type it was decoded with, if any.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of Message.
+//
+// Returns:
+//  description of the content type.
+func (m *Message) DescribeContentType() string {
+	var details []string
+	if _, encoding := m.GetUncompressedBody(); encoding != "" {
+		details = append(details, encoding)
+	}
+	if _, messageType := m.DecodeProtobuf(); messageType != "" {
+		details = append(details, "protobuf: "+messageType)
+	}
+
+	if len(details) == 0 {
+		return m.GetDisplayContentType()
+	}
+
+	return fmt.Sprintf("%s (%s)", m.GetDisplayContentType(), strings.Join(details, ", "))
+}
+
+// GetContentType returns the content type declared by the producer (via application property) or, if none was
+// declared, the one detected from the payload.
+//
+// Parameters:
+//  props: application properties of the event.
+//  data: payload of the event.
+//
+// Returns:
+//  content type of the payload.
+func GetContentType(props map[string]interface{}, data []byte) string {
+	for key, value := range props {
+		if strings.EqualFold(key, contentTypeProperty) {
+			if declared, ok := value.(string); ok && declared != "" {
+				return declared
+			}
+		}
+	}
+
+	return DetectContentType(data)
+}
+
+// DetectContentType guesses the content type of a payload.
+//
+// Parameters:
+//  data: payload that will be checked.
+//
+// Returns:
+//  detected content type.
+func DetectContentType(data []byte) string {
+	if len(data) > 0 && json.Valid(data) {
+		return contentTypeJson
+	}
+
+	detected := http.DetectContentType(data)
+	if strings.HasPrefix(detected, "text/plain") && !utf8.Valid(data) {
+		return contentTypeBinary
+	}
+
+	return detected
+}
+
+// IsTextContentType checks if a content type represents a payload that can be displayed as text.
+//
+// Parameters:
+//  contentType: content type that will be checked.
+//
+// Returns:
+//  true if it's a text content type. false otherwise.
+func IsTextContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "xml")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io/ioutil"
+)
+
+// NewProtobufDecoder loads the FileDescriptorSet configured in 'protobuf' and looks up the configured message types.
+// Will panic in case of failure.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  new instance of ProtobufDecoder. nil if no descriptor set was configured.
+func NewProtobufDecoder() *ProtobufDecoder {
+	cfg := currentConfig.Protobuf
+	if cfg.DescriptorSet == "" {
+		return nil
+	}
+
+	files := LoadDescriptorSet(cfg.DescriptorSet)
+	decoder := &ProtobufDecoder{
+		eventTypeProperty: cfg.EventTypeProperty,
+		byEventType:       make(map[string]protoreflect.MessageDescriptor),
+	}
+
+	if cfg.MessageType != "" {
+		decoder.defaultType = FindMessageType(files, cfg.MessageType)
+	}
+	for _, typeCfg := range cfg.Types {
+		decoder.byEventType[typeCfg.EventType] = FindMessageType(files, typeCfg.MessageType)
+	}
+
+	return decoder
+}
+
+// LoadDescriptorSet reads a compiled FileDescriptorSet (e.g.: protoc --include_imports --descriptor_set_out).
+// Will panic in case of failure.
+//
+// Parameters:
+//  path: path of the descriptor set file.
+//
+// Returns:
+//  registry with every file of the descriptor set.
+func LoadDescriptorSet(path string) *protoregistry.Files {
+	data, err := ioutil.ReadFile(path)
+	HandleError(fmt.Sprintf("Failed to read protobuf descriptor set '%s'.", path), err, true)
+
+	set := &descriptorpb.FileDescriptorSet{}
+	err = proto.Unmarshal(data, set)
+	HandleError(fmt.Sprintf("Failed to parse protobuf descriptor set '%s'.", path), err, true)
+
+	files, err := protodesc.NewFiles(set)
+	HandleError(fmt.Sprintf("Invalid protobuf descriptor set '%s'.", path), err, true)
+
+	return files
+}
+
+// FindMessageType looks up a message type in a descriptor set.
+// Will panic if the message type does not exist.
+//
+// Parameters:
+//  files: registry with every file of the descriptor set.
+//  name: full name of the message type (e.g.: acme.orders.OrderCreated).
+//
+// Returns:
+//  descriptor of the message type.
+func FindMessageType(files *protoregistry.Files, name string) protoreflect.MessageDescriptor {
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	HandleError(fmt.Sprintf("Protobuf message type '%s' was not found in the descriptor set.", name), err, true)
+
+	msgDescriptor, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		HandleError("Invalid protobuf configuration", fmt.Errorf("'%s' is not a message type", name), true)
+	}
+
+	return msgDescriptor
+}
+
+// MessageTypeFor returns the protobuf message type of the payload of a Message: the one configured for its event
+// type or, if there's none, the default one.
+//
+// Parameters:
+//  msg: Message with the payload.
+//
+// Receiver:
+//  Instance of ProtobufDecoder.
+//
+// Returns:
+//  descriptor of the message type. nil if the payload should not be decoded.
+func (d *ProtobufDecoder) MessageTypeFor(msg Message) protoreflect.MessageDescriptor {
+	if d.eventTypeProperty != "" {
+		if descriptor, found := d.byEventType[msg.Properties[d.eventTypeProperty]]; found {
+			return descriptor
+		}
+	}
+
+	return d.defaultType
+}
+
+// Decode converts the protobuf payload of a Message to JSON. Compressed payloads are decompressed first.
+// Payloads that can't be decoded with their message type are not converted.
+//
+// Parameters:
+//  msg: Message with the payload.
+//
+// Receiver:
+//  Instance of ProtobufDecoder.
+//
+// Returns:
+//  JSON representation of the payload and the full name of its message type. nil and empty if it was not decoded.
+func (d *ProtobufDecoder) Decode(msg Message) ([]byte, string) {
+	descriptor := d.MessageTypeFor(msg)
+	if descriptor == nil {
+		return nil, ""
+	}
+
+	body, _ := msg.GetUncompressedBody()
+	decoded := dynamicpb.NewMessage(descriptor)
+	if err := proto.Unmarshal(body, decoded); err != nil {
+		return nil, ""
+	}
+
+	data, err := protojson.Marshal(decoded)
+	if err != nil {
+		return nil, ""
+	}
+
+	return data, string(descriptor.FullName())
+}
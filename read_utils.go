@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/dgraph-io/badger/v3"
+	"log"
+	"sort"
+	"strings"
+)
+
+// NewReadStats creates an empty instance of ReadStats.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  new instance of ReadStats.
+func NewReadStats() *ReadStats {
+	return &ReadStats{
+		LastSeqNumbers:   make(map[string]int64),
+		TargetSeqNumbers: make(map[string]int64),
+		stopped:          make(chan struct{}),
+	}
+}
+
+// Stopped returns a channel that is closed when the read operation must stop.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  channel that will be closed once a stop condition is reached.
+func (s *ReadStats) Stopped() <-chan struct{} {
+	return s.stopped
+}
+
+// Stop signals that the read operation must stop. Only the first reason is kept.
+//
+// Parameters:
+//  reason: why the read operation is stopping.
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  Nothing.
+func (s *ReadStats) Stop(reason string) {
+	s.stopOnce.Do(func() {
+		s.mu.Lock()
+		s.StopReason = reason
+		s.mu.Unlock()
+		close(s.stopped)
+	})
+}
+
+// IsStopped checks if a stop condition was already reached.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  true if the read operation must stop. false otherwise.
+func (s *ReadStats) IsStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// WatchPartition registers the sequence number a partition must reach to be considered caught up.
+//
+// Parameters:
+//  partitionId: label of the partition (see GetPartitionLabel).
+//  initialSeqNumber: sequence number of the last message considered processed before reading starts.
+//  info: runtime information of the partition.
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  Nothing.
+func (s *ReadStats) WatchPartition(partitionId string, initialSeqNumber int64, info *eventhub.HubPartitionRuntimeInformation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastSeqNumbers[partitionId] = initialSeqNumber
+	s.TargetSeqNumbers[partitionId] = info.LastSequenceNumber
+}
+
+// Track registers a processed Message and stops the read operation if any of the configured bounds was reached.
+//
+// Parameters:
+//  msg: Message that was processed.
+//  result: what happened to the Message (saved, already in the database or skipped by the filter).
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  Nothing.
+func (s *ReadStats) Track(msg Message, result WriteResult) {
+	s.mu.Lock()
+	s.Processed++
+	switch result {
+	case writeResultStored:
+		s.Stored++
+	case writeResultSkipped:
+		s.Skipped++
+	}
+	if msg.ValidationStatus == validationStatusInvalid {
+		s.Invalid++
+	}
+	if msg.EventSeqNumber != nil {
+		s.LastSeqNumbers[GetPartitionLabel(msg.Source, msg.PartitionId)] = *msg.EventSeqNumber
+	}
+	processed := s.Processed
+	s.mu.Unlock()
+
+	if messageFilter != nil {
+		DescribeReadProgress()
+	}
+
+	if currentConfig.MaxMessages > 0 && processed >= currentConfig.MaxMessages {
+		s.Stop(stopReasonMaxMessages)
+		return
+	}
+
+	s.CheckCaughtUp()
+}
+
+// IsMaxMessagesPending checks if the messages waiting to be saved are enough to reach the max number of messages.
+//
+// Parameters:
+//  pending: number of messages waiting to be saved.
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  true if the max number of messages will be reached once the pending messages are saved. false otherwise.
+func (s *ReadStats) IsMaxMessagesPending(pending int) bool {
+	if currentConfig.MaxMessages <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Processed+int64(pending) >= currentConfig.MaxMessages
+}
+
+// CheckCaughtUp stops the read operation if it should run until caught up and every partition reached the
+// last sequence number it had when reading started.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  Nothing.
+func (s *ReadStats) CheckCaughtUp() {
+	if !currentConfig.UntilCaughtUp || !s.IsCaughtUp() {
+		return
+	}
+	s.Stop(stopReasonCaughtUp)
+}
+
+// IsCaughtUp checks if every watched partition reached its target sequence number.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  true if every partition is caught up. false otherwise.
+func (s *ReadStats) IsCaughtUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.TargetSeqNumbers) == 0 {
+		return false
+	}
+
+	for partitionId, target := range s.TargetSeqNumbers {
+		if s.LastSeqNumbers[partitionId] < target {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PrintSummary logs what was processed by the read operation.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  Nothing.
+func (s *ReadStats) PrintSummary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Println("----| SUMMARY | -----------------------------------")
+	if s.StopReason != "" {
+		log.Printf("Stopped because: %s\n", s.StopReason)
+	}
+	log.Printf("Messages processed: %d (new: %d, already in database: %d, skipped by filter: %d)\n",
+		s.Processed, s.Stored, s.Processed-s.Stored-s.Skipped, s.Skipped)
+	if schemaValidator != nil {
+		log.Printf("Messages not valid according to the JSON Schemas: %d\n", s.Invalid)
+	}
+
+	var partitions []string
+	for partitionId := range s.LastSeqNumbers {
+		partitions = append(partitions, partitionId)
+	}
+	sort.Strings(partitions)
+
+	for _, partitionId := range partitions {
+		if target, watched := s.TargetSeqNumbers[partitionId]; watched {
+			log.Printf("Partition '%s': last sequence number %d of %d\n",
+				partitionId, s.LastSeqNumbers[partitionId], target)
+			continue
+		}
+		log.Printf("Partition '%s': last sequence number %d\n", partitionId, s.LastSeqNumbers[partitionId])
+	}
+	PrintDumpSummary()
+	log.Println("--------------------------------------------------")
+}
+
+// GetReadExitCode returns the exit code that matches the reason why the read operation stopped.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ReadStats.
+//
+// Returns:
+//  exit code for the application.
+func (s *ReadStats) GetReadExitCode() int {
+	s.mu.Lock()
+	reason := s.StopReason
+	s.mu.Unlock()
+
+	if reason == stopReasonInterrupted {
+		return exitCodeFailure
+	}
+
+	if reason == stopReasonMaxDuration && currentConfig.UntilCaughtUp && !s.IsCaughtUp() {
+		return exitCodeNotCaughtUp
+	}
+
+	return exitCodeSuccess
+}
+
+// DescribeReadProgress updates the description of the progress bar with what's being stored and skipped, when
+// there's a filter, and the partitions this instance owns, when partitions are load balanced.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  Nothing.
+func DescribeReadProgress() {
+	if pBar == nil || readStats == nil {
+		return
+	}
+
+	description := "Reading messages..."
+	if messageFilter != nil {
+		readStats.mu.Lock()
+		description += fmt.Sprintf(" (stored: %d, skipped: %d)", readStats.Stored, readStats.Skipped)
+		readStats.mu.Unlock()
+	}
+	if len(leaseBalancers) > 0 {
+		var owned []string
+		for name, balancer := range leaseBalancers {
+			for _, partitionId := range balancer.Owned() {
+				owned = append(owned, GetPartitionLabel(name, partitionId))
+			}
+		}
+		sort.Strings(owned)
+		description += fmt.Sprintf(" [partitions owned: %s]", strings.Join(owned, ","))
+	}
+
+	pBar.Describe(description)
+}
+
+// WatchPartitionsUntilCaughtUp fetches the last sequence number of each partition of a source, so the read operation
+// knows when it's caught up. Must be called before the receivers start.
+// Will panic in case of failure.
+//
+// Parameters:
+//  ctx: context used to query the eventhub.
+//  hub: eventhub client.
+//  db: badger database where the checkpoints are stored.
+//  source: eventhub that will be read.
+//  partitions: partitions that will be read.
+//
+// Returns:
+//  Nothing.
+func WatchPartitionsUntilCaughtUp(ctx context.Context, hub HubClient, db *badger.DB, source SourceConfig, partitions []string) {
+	for _, partitionId := range partitions {
+		info, err := hub.GetPartitionInformation(ctx, partitionId)
+		HandleError(fmt.Sprintf("Failed to get runtime information of partition '%s' of '%s'",
+			partitionId, source.Name), err, true)
+		readStats.WatchPartition(GetPartitionLabel(source.Name, partitionId),
+			GetInitialSequenceNumber(db, source, partitionId, info), info)
+	}
+}
+
+// GetInitialSequenceNumber returns the sequence number of the last message that is considered processed before
+// reading starts, based on the configured start position.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database where the checkpoints are stored.
+//  source: eventhub that will be read.
+//  partitionId: id of the partition.
+//  info: runtime information of the partition.
+//
+// Returns:
+//  sequence number of the last message considered processed.
+func GetInitialSequenceNumber(db *badger.DB, source SourceConfig, partitionId string, info *eventhub.HubPartitionRuntimeInformation) int64 {
+	// messages older than the beginning of the partition expired, so they can't be read anyway.
+	expired := info.BeginningSequenceNumber - 1
+
+	switch currentConfig.StartPosition {
+	case startPositionEarliest:
+		return expired
+
+	case startPositionLatest:
+		return info.LastSequenceNumber
+
+	case startPositionSequenceNumber:
+		if currentConfig.StartSequenceNumber-1 > expired {
+			return currentConfig.StartSequenceNumber - 1
+		}
+		return expired
+
+	case startPositionEnqueuedTime:
+		if !info.LastEnqueuedTimeUtc.After(currentConfig.StartEnqueuedTime) {
+			return info.LastSequenceNumber
+		}
+		return expired
+	}
+
+	if db == nil {
+		return expired
+	}
+
+	if checkpoint := LoadCheckpoint(db, source, partitionId); checkpoint != nil && checkpoint.SequenceNumber > expired {
+		return checkpoint.SequenceNumber
+	}
+
+	return expired
+}
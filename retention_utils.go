@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseRetentionAge parses how long messages are kept. Besides the units accepted by time.ParseDuration, days are
+// accepted (e.g.: 30d).
+//
+// Parameters:
+//  value: age that will be parsed.
+//
+// Returns:
+//  parsed age and error, if it's not valid.
+func ParseRetentionAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// GetExpiresAt returns when a Message expires, based on when it was enqueued and on 'retention.maxAge'.
+//
+// Parameters:
+//  msg: Message that will be saved.
+//
+// Returns:
+//  expiration as unix time, in seconds, like badger expects it. 0 if the Message never expires.
+func GetExpiresAt(msg Message) uint64 {
+	if retentionMaxAge <= 0 {
+		return 0
+	}
+
+	enqueuedAt := msg.QueuedTime
+	if enqueuedAt.IsZero() {
+		enqueuedAt = msg.ProcessedAt
+	}
+
+	return uint64(enqueuedAt.Add(retentionMaxAge).Unix())
+}
+
+// NewStoredEntry creates a badger entry that expires at a given time.
+//
+// Parameters:
+//  key: key of the entry.
+//  value: value of the entry.
+//  expiresAt: expiration as unix time, in seconds. 0 if the entry never expires.
+//
+// Returns:
+//  badger entry.
+func NewStoredEntry(key []byte, value []byte, expiresAt uint64) *badger.Entry {
+	entry := badger.NewEntry(key, value)
+	entry.ExpiresAt = expiresAt
+	return entry
+}
+
+// PruneMessages deletes, with their index keys, the messages older than 'retention.maxAge' and then the oldest
+// messages until the stored messages fit in 'retention.maxSizeMB'. Messages are found by the enqueued time index,
+// so messages that were never indexed are not pruned (see RebuildIndexes).
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database that will be pruned.
+//
+// Returns:
+//  number of messages deleted.
+func PruneMessages(db *badger.DB) int {
+	maxSize := currentConfig.Retention.MaxSizeMB * 1024 * 1024
+	prefix := []byte(GetTimeIndexPrefix())
+	cutoff := []byte(fmt.Sprintf("%s%020d/\xff", prefix, time.Now().Add(-retentionMaxAge).UnixNano()))
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	pruned := 0
+	err := db.View(func(txn *badger.Txn) error {
+		var total int64
+		if maxSize > 0 {
+			total = getMessagesSize(txn)
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.ValidForPrefix(prefix); iter.Next() {
+			tooOld := retentionMaxAge > 0 && bytes.Compare(iter.Item().Key(), cutoff) <= 0
+			tooBig := maxSize > 0 && total > maxSize
+			if !tooOld && !tooBig {
+				break
+			}
+
+			msgKey, err := iter.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			item, err := txn.Get(msgKey)
+			if err == badger.ErrKeyNotFound {
+				// the message is already gone, only the index key is left.
+				if err = wb.Delete(iter.Item().KeyCopy(nil)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			total -= item.EstimatedSize()
+			err = item.Value(func(val []byte) error {
+				msg := Deserialize(val)
+				msg.Key = string(msgKey)
+				for _, key := range append(GetIndexKeys(*msg), msgKey) {
+					if err := wb.Delete(key); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	HandleError("Failed to prune messages.", err, true)
+	HandleError("Failed to delete pruned messages.", wb.Flush(), true)
+
+	return pruned
+}
+
+// getMessagesSize adds up the approximate size of every message in the database (key and value). It doesn't include
+// data that was deleted but is still on disk, waiting for the value log garbage collection.
+//
+// Parameters:
+//  txn: badger transaction used to read.
+//
+// Returns:
+//  approximate size of the messages, in bytes.
+func getMessagesSize(txn *badger.Txn) int64 {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	var total int64
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if !IsReservedKey(iter.Item().Key()) {
+			total += iter.Item().EstimatedSize()
+		}
+	}
+
+	return total
+}
+
+// RunValueLogGC rewrites the value log files with more than 'retention.gcDiscardRatio' of deleted or expired data,
+// so the space is given back to the disk.
+//
+// Parameters:
+//  db: badger database.
+//
+// Returns:
+//  number of value log files rewritten.
+func RunValueLogGC(db *badger.DB) int {
+	rewritten := 0
+	for StillHaveConnection(db) && db.RunValueLogGC(currentConfig.Retention.GcDiscardRatio) == nil {
+		rewritten++
+	}
+
+	return rewritten
+}
+
+// RunRetention is a routine that applies the retention policy and runs the value log garbage collection every
+// 'retention.gcInterval', while reading.
+//
+// Parameters:
+//  ctx: context of the read operation. once it's cancelled, the routine returns.
+//  db: badger database.
+//  done: channel that will be closed when this routine returns.
+//
+// Returns:
+//  Nothing.
+func RunRetention(ctx context.Context, db *badger.DB, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(valueLogGcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if retentionMaxAge > 0 || currentConfig.Retention.MaxSizeMB > 0 {
+				if pruned := PruneMessages(db); pruned > 0 {
+					log.Printf("Retention: %d message(s) pruned.\n", pruned)
+				}
+			}
+			RunValueLogGC(db)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NewSchemaValidator compiles the JSON Schemas configured in 'schemaValidation'.
+// Will panic in case of failure.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  new instance of SchemaValidator. nil if no schema was configured.
+func NewSchemaValidator() *SchemaValidator {
+	cfg := currentConfig.SchemaValidation
+	if len(cfg.Schemas) == 0 {
+		return nil
+	}
+
+	validator := &SchemaValidator{
+		eventTypeProperty: cfg.EventTypeProperty,
+		byEventType:       make(map[string][]CompiledSchema),
+	}
+
+	for _, schemaCfg := range cfg.Schemas {
+		schema, err := jsonschema.Compile(schemaCfg.File)
+		HandleError(fmt.Sprintf("Failed to compile JSON Schema '%s'.", schemaCfg.File), err, true)
+
+		compiled := CompiledSchema{Name: filepath.Base(schemaCfg.File), schema: schema}
+		if schemaCfg.EventType == "" {
+			validator.defaults = append(validator.defaults, compiled)
+			continue
+		}
+		validator.byEventType[schemaCfg.EventType] = append(validator.byEventType[schemaCfg.EventType], compiled)
+	}
+
+	return validator
+}
+
+// SchemasFor returns the schemas a Message must be valid against: the ones configured for its event type or, if
+// there are none, the ones configured without an event type.
+//
+// Parameters:
+//  msg: Message that will be validated.
+//
+// Receiver:
+//  Instance of SchemaValidator.
+//
+// Returns:
+//  schemas that apply to the Message.
+func (v *SchemaValidator) SchemasFor(msg Message) []CompiledSchema {
+	if v.eventTypeProperty != "" {
+		if schemas, found := v.byEventType[msg.Properties[v.eventTypeProperty]]; found {
+			return schemas
+		}
+	}
+
+	return v.defaults
+}
+
+// Validate checks the payload of a Message against the schemas that apply to it.
+//
+// Parameters:
+//  msg: Message that will be validated.
+//
+// Receiver:
+//  Instance of SchemaValidator.
+//
+// Returns:
+//  validation status (see validationStatus* constants) and the violations found.
+func (v *SchemaValidator) Validate(msg Message) (string, []SchemaViolation) {
+	schemas := v.SchemasFor(msg)
+	if len(schemas) == 0 {
+		return validationStatusNoSchema, nil
+	}
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(msg.GetDisplayBody()))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return validationStatusInvalid, []SchemaViolation{{
+			Schema:  schemas[0].Name,
+			Rule:    "(payload is not JSON)",
+			Message: err.Error(),
+		}}
+	}
+
+	var violations []SchemaViolation
+	for _, schema := range schemas {
+		err := schema.schema.Validate(doc)
+		if err == nil {
+			continue
+		}
+
+		validationErr, ok := err.(*jsonschema.ValidationError)
+		if !ok {
+			violations = append(violations, SchemaViolation{Schema: schema.Name, Rule: "(validation failed)", Message: err.Error()})
+			continue
+		}
+		violations = append(violations, GetSchemaViolations(schema.Name, validationErr)...)
+	}
+
+	if len(violations) > 0 {
+		return validationStatusInvalid, violations
+	}
+	return validationStatusValid, nil
+}
+
+// GetSchemaViolations flattens a validation error into the violations that caused it (the leaves of the error tree).
+//
+// Parameters:
+//  schema: name of the schema.
+//  err: validation error.
+//
+// Returns:
+//  list of violations.
+func GetSchemaViolations(schema string, err *jsonschema.ValidationError) []SchemaViolation {
+	if len(err.Causes) == 0 {
+		return []SchemaViolation{{
+			Schema:           schema,
+			Rule:             err.KeywordLocation,
+			InstanceLocation: err.InstanceLocation,
+			Message:          err.Message,
+		}}
+	}
+
+	var violations []SchemaViolation
+	for _, cause := range err.Causes {
+		violations = append(violations, GetSchemaViolations(schema, cause)...)
+	}
+	return violations
+}
+
+// ValidateMessage sets the validation status of a Message, if schema validation is configured.
+//
+// Parameters:
+//  msg: Message that will be validated.
+//
+// Returns:
+//  Nothing.
+func ValidateMessage(msg *Message) {
+	if schemaValidator == nil {
+		return
+	}
+
+	msg.ValidationStatus, _ = schemaValidator.Validate(*msg)
+}
+
+// NewValidationReport creates an empty ValidationReport.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  new instance of ValidationReport.
+func NewValidationReport() *ValidationReport {
+	return &ValidationReport{
+		Statuses: make(map[string]int),
+		Rules:    make(map[string][]SchemaViolation),
+	}
+}
+
+// Add registers the result of validating a Message.
+//
+// Parameters:
+//  key: badger key of the Message.
+//  status: validation status of the Message.
+//  violations: violations found in the Message.
+//
+// Receiver:
+//  Instance of ValidationReport.
+//
+// Returns:
+//  Nothing.
+func (r *ValidationReport) Add(key string, status string, violations []SchemaViolation) {
+	r.Checked++
+	r.Statuses[status]++
+
+	for _, violation := range violations {
+		violation.Key = key
+		rule := fmt.Sprintf("%s#%s", violation.Schema, violation.Rule)
+		r.Rules[rule] = append(r.Rules[rule], violation)
+	}
+}
+
+// String converts the report to text: totals, followed by the violations grouped by rule, most frequent first.
+// Only the first examples of each rule are listed.
+//
+// Parameters:
+//  None.
+//
+// Receiver:
+//  Instance of ValidationReport.
+//
+// Returns:
+//  text representation of the report.
+func (r *ValidationReport) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Messages checked: %d (valid: %d, invalid: %d, without schema: %d)\n",
+		r.Checked,
+		r.Statuses[validationStatusValid],
+		r.Statuses[validationStatusInvalid],
+		r.Statuses[validationStatusNoSchema]))
+
+	var rules []string
+	for rule := range r.Rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if len(r.Rules[rules[i]]) != len(r.Rules[rules[j]]) {
+			return len(r.Rules[rules[i]]) > len(r.Rules[rules[j]])
+		}
+		return rules[i] < rules[j]
+	})
+
+	for _, rule := range rules {
+		violations := r.Rules[rule]
+		sb.WriteString(fmt.Sprintf("\n---| %s | %d violation(s)\n", rule, len(violations)))
+		for i, violation := range violations {
+			if i == validationExamples {
+				sb.WriteString(fmt.Sprintf("  ... and %d more\n", len(violations)-i))
+				break
+			}
+			sb.WriteString(fmt.Sprintf("  %s at '%s': %s\n", violation.Key, violation.InstanceLocation, violation.Message))
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GetSource returns the configuration of a source, by name. Messages without a source (e.g.: fake messages used by
+// the benchmark) use the top level of the configuration file.
+//
+// Parameters:
+//  name: name of the source.
+//
+// Returns:
+//  configuration of the source.
+func GetSource(name string) SourceConfig {
+	for _, source := range currentConfig.Sources {
+		if source.Name == name {
+			return source
+		}
+	}
+
+	return SourceConfig{
+		Name:                     name,
+		EventhubConnectionString: currentConfig.EventhubConnectionString,
+		EntityPath:               currentConfig.EntityPath,
+		ConsumerGroup:            currentConfig.ConsumerGroup,
+		Partitions:               currentConfig.Partitions,
+	}
+}
+
+// GetPartitionLabel returns how a partition is identified in the progress and in the summary. When there's more than
+// one source, partitions are prefixed with the name of their source, since partition ids repeat across eventhubs.
+//
+// Parameters:
+//  source: name of the source.
+//  partitionId: id of the partition.
+//
+// Returns:
+//  label of the partition.
+func GetPartitionLabel(source string, partitionId string) string {
+	if len(currentConfig.Sources) <= 1 {
+		return partitionId
+	}
+
+	return fmt.Sprintf("%s/%s", source, partitionId)
+}
+
+// GetSourcesDescription describes the configured sources, for logging.
+//
+// Parameters:
+//  None.
+//
+// Returns:
+//  description of the sources.
+func GetSourcesDescription() string {
+	var entities []string
+	for _, source := range currentConfig.Sources {
+		entities = append(entities, fmt.Sprintf("'%s'", source.EntityPath))
+	}
+
+	if len(entities) == 1 {
+		return "entity " + entities[0]
+	}
+	return "entities " + strings.Join(entities, ", ")
+}
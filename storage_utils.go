@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/golang/snappy"
+	"github.com/schollz/progressbar/v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GetStorageHeader returns the header of the values saved to badgerDb: the magic bytes 'HTM' followed by one byte
+// with the version of the storage format.
+//  - version 1: the rest of the value is the Message encoded as JSON.
+//  - version 2: same as version 1, but the payload may be compressed, as informed by 'bodyCompression'.
+//
+// Parameters:
+//  version: version of the storage format.
+//
+// Returns:
+//  header of the value.
+func GetStorageHeader(version byte) []byte {
+	return append([]byte(storageMagic), version)
+}
+
+// GetStorageFormat reads the header of a value saved to badgerDb.
+//
+// Parameters:
+//  data: value saved to badgerDb.
+//
+// Returns:
+//  version of the storage format (storageFormatGob if there's no header) and the value without the header.
+func GetStorageFormat(data []byte) (byte, []byte) {
+	header := len(storageMagic) + 1
+	if len(data) < header || !bytes.HasPrefix(data, []byte(storageMagic)) {
+		return storageFormatGob, data
+	}
+
+	return data[header-1], data[header:]
+}
+
+// CompressStoredBody compresses the payload of a Message that is about to be saved, with 'storageCompression'.
+// Legacy payloads (MsgData) are moved to Body. If compressing doesn't make the payload smaller, it's kept as it is.
+//
+// Parameters:
+//  msg: copy of the Message that will be saved. it's changed in place.
+//
+// Returns:
+//  Nothing.
+func CompressStoredBody(msg *Message) {
+	if currentConfig.StorageCompression == "" || currentConfig.StorageCompression == storageCompressionNone ||
+		msg.BodyCompression != "" {
+		return
+	}
+
+	body := msg.GetBody()
+	if len(body) == 0 {
+		return
+	}
+
+	var compressed []byte
+	switch currentConfig.StorageCompression {
+	case storageCompressionSnappy:
+		compressed = snappy.Encode(nil, body)
+	case storageCompressionZstd:
+		if initZstd() != nil {
+			return
+		}
+		compressed = zstdEncoder.EncodeAll(body, nil)
+	}
+
+	if len(compressed) == 0 || len(compressed) >= len(body) {
+		return
+	}
+
+	msg.Body = compressed
+	msg.MsgData = ""
+	msg.BodyCompression = currentConfig.StorageCompression
+}
+
+// DecompressStoredBody decompresses the payload of a Message read from badgerDb, if it was compressed.
+//
+// Parameters:
+//  msg: Message that was read. it's changed in place.
+//
+// Returns:
+//  error if the payload could not be decompressed.
+func DecompressStoredBody(msg *Message) error {
+	var body []byte
+	var err error
+
+	switch msg.BodyCompression {
+	case "":
+		return nil
+	case storageCompressionSnappy:
+		body, err = snappy.Decode(nil, msg.Body)
+	case storageCompressionZstd:
+		if err = initZstd(); err == nil {
+			body, err = zstdDecoder.DecodeAll(msg.Body, nil)
+		}
+	default:
+		err = fmt.Errorf("payload compression '%s' is not supported", msg.BodyCompression)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	msg.Body = body
+	msg.BodyCompression = ""
+	return nil
+}
+
+// MigrateStorage rewrites, in place, every message saved with an older storage format using the current one.
+// Messages saved by older versions under their event id alone are also moved to the key built with 'dedupKey' (see
+// rekeyMessage). Messages already in the current format and key are not changed, so it can be run again if
+// interrupted. Expirations are kept.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database that will be migrated.
+//
+// Returns:
+//  number of messages migrated and number of messages that were already in the current format.
+func MigrateStorage(db *badger.DB) (int, int) {
+	pBar = progressbar.Default(int64(CountMessages(db)), "Migrating messages...")
+	defer func() { _ = pBar.Close() }()
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	migrated, current := 0, 0
+	err := db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			dbRow := iter.Item()
+			if IsReservedKey(dbRow.Key()) {
+				continue
+			}
+			_ = pBar.Add(1)
+
+			key := dbRow.KeyCopy(nil)
+			isLegacyKey := !strings.HasPrefix(string(key), messageKeyPrefix)
+			err := dbRow.Value(func(val []byte) error {
+				if version, _ := GetStorageFormat(val); version == storageFormatVersion && !isLegacyKey {
+					current++
+					return nil
+				}
+
+				msg := Deserialize(val)
+				migrated++
+				if isLegacyKey {
+					return rekeyMessage(txn, wb, msg, string(key), dbRow.ExpiresAt())
+				}
+				return wb.SetEntry(NewStoredEntry(key, msg.Serialize(), dbRow.ExpiresAt()))
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	HandleError("Failed to migrate messages.", err, true)
+	HandleError("Failed to save migrated messages.", wb.Flush(), true)
+
+	return migrated, current
+}
+
+// rekeyMessage moves a Message saved by an older version under its event id alone to the key built with 'dedupKey',
+// together with its index keys. Messages without a source are given the first one, like import-capture does. If the
+// new key is already taken (the Message was read again after upgrading), the old copy is just deleted.
+//
+// Parameters:
+//  txn: badger transaction used to look up the new key.
+//  wb: write batch where the Message is moved.
+//  msg: Message that will be moved.
+//  legacyKey: key the Message was saved with.
+//  expiresAt: expiration of the Message, as unix time in seconds. 0 if it never expires.
+//
+// Returns:
+//  error if the Message could not be moved.
+func rekeyMessage(txn *badger.Txn, wb *badger.WriteBatch, msg *Message, legacyKey string, expiresAt uint64) error {
+	msg.Key = legacyKey
+	for _, indexKey := range GetIndexKeys(*msg) {
+		if err := wb.Delete(indexKey); err != nil {
+			return err
+		}
+	}
+	if err := wb.Delete([]byte(legacyKey)); err != nil {
+		return err
+	}
+
+	if msg.Source == "" {
+		msg.Source = currentConfig.Sources[0].Name
+	}
+	msg.Key = GetMessageKey(*msg)
+	if _, err := txn.Get([]byte(msg.Key)); err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	if err := wb.SetEntry(NewStoredEntry([]byte(msg.Key), msg.Serialize(), expiresAt)); err != nil {
+		return err
+	}
+	return SetIndexKeys(wb, *msg, expiresAt)
+}
+
+// CountMessages counts the messages saved to badgerDb, without reading their values.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database.
+//
+// Returns:
+//  number of messages.
+func CountMessages(db *badger.DB) int {
+	return CountMessagesSince(db, 0)
+}
+
+// GetStorageStats reads every stored message to find out how much space the messages use and how well their
+// payloads are compressed.
+// Will panic in case of failure.
+//
+// Parameters:
+//  db: badger database.
+//
+// Returns:
+//  space used by the stored messages.
+func GetStorageStats(db *badger.DB) StorageStats {
+	stats := StorageStats{}
+	err := db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			dbRow := iter.Item()
+			if IsReservedKey(dbRow.Key()) {
+				continue
+			}
+
+			err := dbRow.Value(func(val []byte) error {
+				stored := Message{}
+				if version, payload := GetStorageFormat(val); version == storageFormatGob {
+					stored = *Deserialize(val)
+				} else if err := json.Unmarshal(payload, &stored); err != nil {
+					return err
+				}
+				stats.StoredBodyBytes += int64(len(stored.GetBody()))
+
+				if stored.BodyCompression != "" {
+					stats.Compressed++
+					if err := DecompressStoredBody(&stored); err != nil {
+						return err
+					}
+				}
+				stats.RawBodyBytes += int64(len(stored.GetBody()))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			stats.Messages++
+			stats.StoredBytes += dbRow.EstimatedSize()
+			if pBar != nil {
+				_ = pBar.Add(1)
+			}
+		}
+		return nil
+	})
+	HandleError("Failed to read messages.", err, true)
+
+	stats.DiskBytes = getDirSize(currentConfig.BadgerDir)
+	if currentConfig.BadgerValueDir != currentConfig.BadgerDir {
+		stats.DiskBytes += getDirSize(currentConfig.BadgerValueDir)
+	}
+
+	return stats
+}
+
+// getDirSize adds up the size of every file in a directory and its subdirectories.
+// Will panic in case of failure.
+//
+// Parameters:
+//  dir: path of the directory.
+//
+// Returns:
+//  size of the files, in bytes.
+func getDirSize(dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	HandleError(fmt.Sprintf("Failed to read the size of '%s'.", dir), err, true)
+
+	return size
+}
+
+// GetCompressionRatio divides the uncompressed size by the compressed size.
+//
+// Parameters:
+//  raw: uncompressed size.
+//  compressed: compressed size.
+//
+// Returns:
+//  compression ratio. 0 if there's nothing compressed.
+func GetCompressionRatio(raw int64, compressed int64) float64 {
+	if compressed <= 0 {
+		return 0
+	}
+
+	return float64(raw) / float64(compressed)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/dgraph-io/badger/v3"
+	"strings"
+	"testing"
+)
+
+// TestStoredBodyCompression checks that payloads compressed with 'storageCompression' are read back as they were
+// received, and that payloads that don't get smaller are kept as they are.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestStoredBodyCompression(t *testing.T) {
+	defer func() { currentConfig = Config{} }()
+	payload := []byte(strings.Repeat(`{"tenant":"acme","amount":10}`, 50))
+
+	for _, compression := range []string{storageCompressionNone, storageCompressionSnappy, storageCompressionZstd} {
+		currentConfig = Config{StorageCompression: compression}
+		msg := Message{EventId: "abc", Body: payload}
+		data := msg.Serialize()
+		if compression != storageCompressionNone && len(data) >= len(payload) {
+			t.Errorf("message saved with %s has %d bytes, it was not compressed", compression, len(data))
+		}
+
+		if stored := Deserialize(data); !bytes.Equal(stored.Body, payload) || stored.BodyCompression != "" {
+			t.Errorf("payload saved with %s is read back different", compression)
+		}
+	}
+
+	msg := Message{Body: []byte{1, 2, 3}}
+	if stored := Deserialize(msg.Serialize()); !bytes.Equal(stored.Body, msg.Body) {
+		t.Error("payload that doesn't get smaller should be kept as it is")
+	}
+}
+
+// TestMigrateStorageRekeysLegacyMessages saves messages the way older versions did (gob, under the event id) and
+// checks that migrate moves them to the current key, and drops the old copy of a message already saved again.
+//
+// Parameters:
+//  t: state of the test.
+//
+// Returns:
+//  Nothing.
+func TestMigrateStorageRekeysLegacyMessages(t *testing.T) {
+	db := openTestDatabase(t.TempDir())
+	defer CloseConnection()
+	currentConfig.Sources = []SourceConfig{{Name: "demo"}}
+
+	saveLegacyTestMessage(t, db, "event-0")
+	saveLegacyTestMessage(t, db, "event-1")
+	saved := Message{EventId: "event-1", PartitionId: "0", Source: "demo", Body: []byte("payload")}
+	saved.Key = GetMessageKey(saved)
+	writer := NewMessageWriter(db, 1, nil)
+	writer.Add(saved)
+
+	migrated, current := MigrateStorage(db)
+	if migrated != 2 || current != 1 {
+		t.Fatalf("migrated %d messages (%d already current), want 2 (1 already current)", migrated, current)
+	}
+	if count := CountMessages(db); count != 2 {
+		t.Fatalf("database has %d messages after migrating, want 2", count)
+	}
+
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("msg/demo/0/id/event-0"))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if version, _ := GetStorageFormat(val); version != storageFormatVersion {
+				t.Errorf("migrated message has storage format %d", version)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("migrated message not found: %v", err)
+	}
+}
+
+// saveLegacyTestMessage saves a Message the way versions before the storage header did: encoded with gob, under
+// its event id.
+//
+// Parameters:
+//  t: state of the test.
+//  db: badger database.
+//  eventId: id of the Message.
+//
+// Returns:
+//  Nothing.
+func saveLegacyTestMessage(t *testing.T, db *badger.DB, eventId string) {
+	var data bytes.Buffer
+	msg := Message{EventId: eventId, PartitionId: "0", Body: []byte("payload")}
+	if err := gob.NewEncoder(&data).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(eventId), data.Bytes())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
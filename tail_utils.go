@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TailMessages is a routine that prints received messages to the terminal, in the configured format, without
+// storing them. Messages that don't match the filter are not printed.
+//
+// Parameters:
+//  readCtx: context of the read operation.
+//  done: channel that will be closed when this routine returns.
+//
+// Returns:
+//  Nothing.
+func TailMessages(readCtx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case msg := <-messageChannel:
+			result := writeResultSkipped
+			if messageFilter.Matches(msg) {
+				fmt.Println(FormatTailMessage(msg))
+				result = writeResultStored
+			}
+			readStats.Track(msg, result)
+
+		case <-readCtx.Done():
+			return
+		}
+
+		if readStats.IsStopped() {
+			return
+		}
+	}
+}
+
+// FormatTailMessage converts a Message to text, in the format configured in 'tailFormat'.
+//
+// Parameters:
+//  msg: Message that will be printed.
+//
+// Returns:
+//  text representation of the Message.
+func FormatTailMessage(msg Message) string {
+	switch currentConfig.TailFormat {
+	case tailFormatDetails:
+		if currentConfig.TailPrettyJson {
+			msg.Body = PrettyJsonBody(msg)
+			msg.MsgData = ""
+		}
+		details := msg.ToString()
+		if !currentConfig.TailColor {
+			return details + "\n"
+		}
+
+		lines := strings.Split(details, "\n")
+		for i, line := range lines {
+			if strings.HasPrefix(line, "---|") {
+				lines[i] = colorBlue + line + colorReset
+			}
+		}
+		return strings.Join(lines, "\n") + "\n"
+
+	case tailFormatJsonl:
+		return FormatJsonlMessage(msg)
+	}
+
+	return FormatLineMessage(msg)
+}
+
+// FormatLineMessage converts a Message to a compact line: enqueued time, source/partition, sequence number, id,
+// content type and the payload. If pretty JSON is enabled, JSON payloads are printed in the following lines.
+//
+// Parameters:
+//  msg: Message that will be printed.
+//
+// Returns:
+//  one line representation of the Message.
+func FormatLineMessage(msg Message) string {
+	seq := "-"
+	if msg.EventSeqNumber != nil {
+		seq = strconv.FormatInt(*msg.EventSeqNumber, 10)
+	}
+
+	header := fmt.Sprintf("%s %s seq=%s id=%s %s",
+		msg.QueuedTime.Format(time.RFC3339Nano),
+		GetPartitionLabel(msg.Source, msg.PartitionId),
+		seq,
+		msg.EventId,
+		msg.DescribeContentType())
+	if currentConfig.TailColor {
+		header = colorBlue + header + colorReset
+	}
+
+	if currentConfig.TailPrettyJson && IsJsonBody(msg) {
+		return header + "\n" + string(PrettyJsonBody(msg))
+	}
+
+	var body string
+	compact := &bytes.Buffer{}
+	if IsJsonBody(msg) && json.Compact(compact, msg.GetDisplayBody()) == nil {
+		body = compact.String()
+	} else {
+		body = strings.NewReplacer("\r", `\r`, "\n", `\n`).Replace(msg.BodyToString())
+	}
+
+	return header + " " + body
+}
+
+// FormatJsonlMessage converts a Message to a JSON object in a single line. JSON payloads are embedded as they are,
+// text payloads as strings and binary payloads as base64 strings.
+//
+// Parameters:
+//  msg: Message that will be printed.
+//
+// Returns:
+//  JSON representation of the Message.
+func FormatJsonlMessage(msg Message) string {
+	line := map[string]interface{}{
+		"source":           msg.Source,
+		"partitionId":      msg.PartitionId,
+		"id":               msg.EventId,
+		"sequenceNumber":   msg.EventSeqNumber,
+		"offset":           msg.EventOffset,
+		"enqueuedTime":     msg.QueuedTime,
+		"partitionKey":     msg.PartitionKey,
+		"contentType":      msg.ContentType,
+		"properties":       msg.Properties,
+		"systemProperties": msg.SystemProperties,
+	}
+
+	if _, encoding := msg.GetUncompressedBody(); encoding != "" {
+		line["contentEncoding"] = encoding
+	}
+
+	switch {
+	case IsJsonBody(msg):
+		line["body"] = json.RawMessage(msg.GetDisplayBody())
+		if _, messageType := msg.DecodeProtobuf(); messageType != "" {
+			line["protobufType"] = messageType
+		}
+	case msg.IsBinary():
+		line["body"] = msg.BodyToString()
+		line["bodyEncoding"] = "base64"
+	default:
+		line["body"] = msg.BodyToString()
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Sprintf(`{"id":%q,"error":%q}`, msg.EventId, err.Error())
+	}
+
+	return string(data)
+}
+
+// IsJsonBody checks if the payload of a Message is valid JSON, or a protobuf payload decoded to JSON.
+//
+// Parameters:
+//  msg: Message with the payload.
+//
+// Returns:
+//  true if the payload is valid JSON. false otherwise.
+func IsJsonBody(msg Message) bool {
+	return json.Valid(msg.GetDisplayBody())
+}
+
+// PrettyJsonBody indents the payload of a Message, if it's JSON.
+//
+// Parameters:
+//  msg: Message with the payload.
+//
+// Returns:
+//  indented payload. the original payload if it's not JSON.
+func PrettyJsonBody(msg Message) []byte {
+	pretty := &bytes.Buffer{}
+	if err := json.Indent(pretty, msg.GetDisplayBody(), "", "  "); err != nil {
+		return msg.GetBody()
+	}
+
+	return pretty.Bytes()
+}
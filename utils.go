@@ -48,9 +48,9 @@ func GetDataDumpDir() string {
 // Returns:
 //  String containing the directory used to dump data with sub-folder to organize messages by day.
 func GetDataDumpDirBasedOnTime(ts time.Time) string {
-	dataDumpDir = filepath.Join(currentConfig.MessageDumpDir, ts.Format("2006-01-02"))
-	EnsureDirExists(dataDumpDir)
-	return dataDumpDir
+	dir := filepath.Join(currentConfig.MessageDumpDir, ts.Format("2006-01-02"))
+	EnsureDirExists(dir)
+	return dir
 }
 
 // GetDumpMsgFilename generates a filename based on current time and the eventId.
@@ -62,10 +62,23 @@ func GetDataDumpDirBasedOnTime(ts time.Time) string {
 // Returns:
 //  filename that will be used to dump an eventhub message.
 func GetDumpMsgFilename(eventId string) string {
-	return filepath.Join(
-		dataDumpDir,
-		fmt.Sprintf("%s--%s.txt",
-			time.Now().Format("2006-01-02T15-04-05.00"), eventId))
+	return fmt.Sprintf("%s--%s.txt", time.Now().Format("2006-01-02T15-04-05.00"), eventId)
+}
+
+// GetDumpMsgPath returns the path of the file a Message is dumped to. Encrypted files have the '.enc' extension.
+//
+// Parameters:
+//  msg: Message that will be dumped.
+//
+// Returns:
+//  path of the file.
+func GetDumpMsgPath(msg Message) string {
+	path := filepath.Join(GetDataDumpDirBasedOnTime(msg.ProcessedAt), msg.DumpFilename)
+	if currentConfig.Encryption.EncryptFiles {
+		path += encryptedFileExtension
+	}
+
+	return path
 }
 
 // LoadConfig loads execution configuration from file to the global variable.
@@ -95,9 +108,29 @@ func LoadConfig(f string) {
 //  Nothing.
 func PrintReadAndSafeToDiskPerfWarning() {
 	log.Println("----| WARNING | ----------------------------------")
-	log.Println("Reading to file drastically SLOWS things down.")
-	log.Println("Benchmarks:")
-	log.Println("Save to Database only:		~300 messages/sec")
-	log.Println("Save to Database + file:	~25 messages/sec")
+	log.Println("Reading to file SLOWS things down.")
+	log.Println(fmt.Sprintf("Messages are dumped in background by %d worker(s).", currentConfig.DumpWorkers))
+	if currentConfig.DumpSyncFiles {
+		log.Println("Every file is flushed to disk (dumpSyncFiles), which is a lot slower.")
+	}
+	log.Println("If dumping can't keep up, reading will wait for it.")
 	log.Println("--------------------------------------------------")
 }
+
+// Contains checks if a value is present in a list of strings.
+//
+// Parameters:
+//  list: list of strings that will be searched.
+//  value: value to look for.
+//
+// Returns:
+//  true if the value is in the list. false otherwise.
+func Contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 // ValidateRunConfiguration loads execution configuration from file.
@@ -24,18 +27,222 @@ func ValidateRunConfiguration(f string, op string) {
 			true)
 	}
 
-	if currentConfig.EntityPath == "" {
+	if currentConfig.EntityPath == "" && (len(currentConfig.Sources) == 0 || !IsReadOperation(op)) {
 		HandleError(errMsg,
 			errors.New("key 'entityPath' is missing or empty"),
 			true)
 	}
 
-	if currentConfig.ConsumerGroup == "" && op == "read" {
+	if currentConfig.StartPosition == "" {
+		currentConfig.StartPosition = startPositionCheckpoint
+	}
+
+	// tail doesn't open the database, so there are no checkpoints to start from.
+	if op == "tail" && currentConfig.StartPosition == startPositionCheckpoint {
+		currentConfig.StartPosition = startPositionLatest
+	}
+
+	switch currentConfig.StartPosition {
+	case startPositionCheckpoint, startPositionEarliest, startPositionLatest:
+		break
+
+	case startPositionEnqueuedTime:
+		if currentConfig.StartEnqueuedTime.IsZero() {
+			HandleError(errMsg,
+				errors.New("key 'startEnqueuedTime' is required when 'startPosition' is enqueued-time"),
+				true)
+		}
+		break
+
+	case startPositionSequenceNumber:
+		if currentConfig.StartSequenceNumber < 0 {
+			HandleError(errMsg,
+				errors.New("key 'startSequenceNumber' must not be negative"),
+				true)
+		}
+		break
+
+	default:
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not valid for key 'startPosition'", currentConfig.StartPosition),
+			true)
+	}
+
+	if currentConfig.MaxMessages < 0 {
+		HandleError(errMsg,
+			errors.New("key 'maxMessages' must not be negative"),
+			true)
+	}
+
+	var err error
+	if currentConfig.MaxDuration != "" {
+		maxReadDuration, err = time.ParseDuration(currentConfig.MaxDuration)
+		if err != nil || maxReadDuration <= 0 {
+			HandleError(errMsg,
+				fmt.Errorf("value '%s' is not a valid duration for key 'maxDuration'", currentConfig.MaxDuration),
+				true)
+		}
+	}
+
+	if currentConfig.DedupKey == "" {
+		currentConfig.DedupKey = dedupKeyEventId
+	}
+
+	switch currentConfig.DedupKey {
+	case dedupKeyEventId, dedupKeyPartitionSequence, dedupKeyBodyHash:
+		break
+
+	case dedupKeyProperty:
+		if currentConfig.DedupKeyProperty == "" {
+			HandleError(errMsg,
+				errors.New("key 'dedupKeyProperty' is required when 'dedupKey' is property"),
+				true)
+		}
+		break
+
+	default:
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not valid for key 'dedupKey'", currentConfig.DedupKey),
+			true)
+	}
+
+	messageFilter, err = ParseFilter(currentConfig.Filter)
+	if err != nil {
+		HandleError(errMsg,
+			fmt.Errorf("value of key 'filter' is invalid: %s", err),
+			true)
+	}
+
+	if currentConfig.BatchSize <= 0 {
+		currentConfig.BatchSize = batchSize
+	}
+
+	if currentConfig.BatchFlushInterval == "" {
+		currentConfig.BatchFlushInterval = batchFlushInterval
+	}
+
+	flushInterval, err = time.ParseDuration(currentConfig.BatchFlushInterval)
+	if err != nil || flushInterval <= 0 {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not a valid duration for key 'batchFlushInterval'", currentConfig.BatchFlushInterval),
+			true)
+	}
+
+	if currentConfig.DedupFilterCapacity <= 0 {
+		currentConfig.DedupFilterCapacity = dedupFilterCapacity
+	}
+
+	if currentConfig.Transport == "" {
+		currentConfig.Transport = transportAmqp
+	}
+
+	if currentConfig.Transport != transportAmqp && currentConfig.Transport != transportMemory {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not valid for key 'transport'", currentConfig.Transport),
+			true)
+	}
+
+	if currentConfig.Transport == transportAmqp && currentConfig.EventhubConnectionString == "" && op == "write" {
+		HandleError(errMsg,
+			errors.New("key 'eventhubConnString' is missing or empty"),
+			true)
+	}
+
+	validateSources(errMsg, op)
+	validateExportRange(errMsg)
+	validateRetention(errMsg, op)
+	validateCompression(errMsg)
+	validateEncryption(errMsg, op)
+	validateBackup(errMsg, op)
+
+	if currentConfig.MemoryHub.Partitions <= 0 {
+		currentConfig.MemoryHub.Partitions = memoryHubPartitions
+	}
+
+	if currentConfig.MemoryHub.BodyTemplate == "" {
+		currentConfig.MemoryHub.BodyTemplate = memoryHubBodyTemplate
+	}
+
+	if currentConfig.ShutdownTimeout == "" {
+		currentConfig.ShutdownTimeout = shutdownTimeout
+	}
+
+	gracefulShutdownTimeout, err = time.ParseDuration(currentConfig.ShutdownTimeout)
+	if err != nil || gracefulShutdownTimeout <= 0 {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not a valid duration for key 'shutdownTimeout'", currentConfig.ShutdownTimeout),
+			true)
+	}
+
+	// tail must not take leases from the instances that are reading.
+	if op == "tail" {
+		currentConfig.LoadBalancing.Enabled = false
+	}
+
+	if currentConfig.LoadBalancing.Enabled {
+		validateLoadBalancing(errMsg)
+	}
+
+	if op == "import-capture" && !FileOrDirExists(currentConfig.CaptureDir) {
+		HandleError(errMsg,
+			fmt.Errorf("key 'captureDir' is missing or directory '%s' does not exist", currentConfig.CaptureDir),
+			true)
+	}
+
+	for i, schema := range currentConfig.SchemaValidation.Schemas {
+		if !FileOrDirExists(schema.File) {
+			HandleError(errMsg,
+				fmt.Errorf("JSON Schema %d ('%s') of key 'schemaValidation' does not exist", i+1, schema.File),
+				true)
+		}
+	}
+	schemaValidator = NewSchemaValidator()
+
+	if op == "validate" && schemaValidator == nil {
 		HandleError(errMsg,
-			errors.New("key 'consumerGroup' is missing and I'll not assume $default. really need a consumerGroup to be able to read"),
+			errors.New("key 'schemaValidation' has no schemas. validate needs at least one"),
 			true)
 	}
 
+	if currentConfig.Protobuf.DescriptorSet != "" && !FileOrDirExists(currentConfig.Protobuf.DescriptorSet) {
+		HandleError(errMsg,
+			fmt.Errorf("protobuf descriptor set '%s' does not exist", currentConfig.Protobuf.DescriptorSet),
+			true)
+	}
+	protobufDecoder = NewProtobufDecoder()
+
+	if currentConfig.ValidationReport == "" {
+		currentConfig.ValidationReport = validationReport
+	}
+
+	if currentConfig.TailFormat == "" {
+		currentConfig.TailFormat = tailFormatLine
+	}
+
+	if !Contains([]string{tailFormatDetails, tailFormatLine, tailFormatJsonl}, currentConfig.TailFormat) {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not valid for key 'tailFormat'", currentConfig.TailFormat),
+			true)
+	}
+
+	if currentConfig.OutboundContentEncoding != "" && !IsSupportedContentEncoding(currentConfig.OutboundContentEncoding) {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not valid for key 'outboundContentEncoding'", currentConfig.OutboundContentEncoding),
+			true)
+	}
+
+	if currentConfig.DumpWorkers <= 0 {
+		currentConfig.DumpWorkers = dumpWorkers
+	}
+
+	if currentConfig.DumpQueueSize <= 0 {
+		currentConfig.DumpQueueSize = dumpQueueSize
+	}
+
+	if currentConfig.BenchmarkMessages <= 0 {
+		currentConfig.BenchmarkMessages = benchmarkMessages
+	}
+
 	if currentConfig.BadgerValueLogFileSize == 0 {
 		currentConfig.BadgerValueLogFileSize = badgerValueLogFileSize
 	}
@@ -57,6 +264,10 @@ func ValidateRunConfiguration(f string, op string) {
 		currentConfig.MessageDumpDir = filepath.Join(bDir, messageDumpDir)
 	}
 
+	if op == "decrypt" && currentConfig.Encryption.DecryptPath == "" {
+		currentConfig.Encryption.DecryptPath = currentConfig.MessageDumpDir
+	}
+
 	if currentConfig.OutboundFolder == "" {
 		currentConfig.OutboundFolder = filepath.Join(bDir, outboundFolder)
 	}
@@ -65,6 +276,11 @@ func ValidateRunConfiguration(f string, op string) {
 		currentConfig.OutboundFolderSent = filepath.Join(bDir, outboundFolderSent)
 	}
 
+	if op == "tail" {
+		// tail writes nothing to disk.
+		return
+	}
+
 	EnsureDirExists(currentConfig.BadgerBase)
 	EnsureDirExists(currentConfig.BadgerDir)
 	EnsureDirExists(currentConfig.BadgerValueDir)
@@ -77,3 +293,366 @@ func ValidateRunConfiguration(f string, op string) {
 		EnsureDirExists(currentConfig.OutboundFolderSent)
 	}
 }
+
+// validateLoadBalancing validates the 'loadBalancing' configuration and fills in its defaults.
+// Will panic in case of failure.
+//
+// Parameters:
+//  errMsg: error message used if the configuration is invalid.
+//
+// Returns:
+//  Nothing.
+func validateLoadBalancing(errMsg string) {
+	lb := &currentConfig.LoadBalancing
+
+	if currentConfig.UntilCaughtUp {
+		HandleError(errMsg,
+			errors.New("key 'untilCaughtUp' can't be used with 'loadBalancing'"),
+			true)
+	}
+
+	if lb.LeaseStore == "" {
+		lb.LeaseStore = leaseStoreFile
+	}
+
+	if lb.LeaseStore != leaseStoreFile {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not valid for key 'loadBalancing.leaseStore'", lb.LeaseStore),
+			true)
+	}
+
+	if lb.LeaseDir == "" {
+		HandleError(errMsg,
+			errors.New("key 'loadBalancing.leaseDir' is required when 'loadBalancing.leaseStore' is file"),
+			true)
+	}
+
+	if lb.LeaseDuration == "" {
+		lb.LeaseDuration = leaseDuration
+	}
+
+	var err error
+	partitionLeaseDuration, err = time.ParseDuration(lb.LeaseDuration)
+	if err != nil || partitionLeaseDuration < 3*time.Second {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not valid for key 'loadBalancing.leaseDuration'. it must be at least 3s", lb.LeaseDuration),
+			true)
+	}
+
+	if lb.InstanceName == "" {
+		hostname, err := os.Hostname()
+		HandleError("Failed to get hostname.", err, true)
+		lb.InstanceName = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+}
+
+// validateSources validates the 'sources' configuration. If no source was configured, the top level of the
+// configuration file is the only source. Keys not set in a source are taken from the top level.
+// Will panic in case of failure.
+//
+// Parameters:
+//  errMsg: error message used if the configuration is invalid.
+//  op: desired operation.
+//
+// Returns:
+//  Nothing.
+func validateSources(errMsg string, op string) {
+	if len(currentConfig.Sources) == 0 {
+		currentConfig.Sources = []SourceConfig{{}}
+	}
+
+	names := make(map[string]bool)
+	for i := range currentConfig.Sources {
+		source := &currentConfig.Sources[i]
+		if source.EventhubConnectionString == "" {
+			source.EventhubConnectionString = currentConfig.EventhubConnectionString
+		}
+		if source.EntityPath == "" {
+			source.EntityPath = currentConfig.EntityPath
+		}
+		if source.ConsumerGroup == "" {
+			source.ConsumerGroup = currentConfig.ConsumerGroup
+		}
+		if len(source.Partitions) == 0 {
+			source.Partitions = currentConfig.Partitions
+		}
+		if source.Name == "" {
+			source.Name = source.EntityPath
+		}
+
+		if source.EntityPath == "" {
+			HandleError(errMsg,
+				fmt.Errorf("key 'entityPath' is missing or empty in source %d", i+1),
+				true)
+		}
+
+		if strings.Contains(source.Name, "/") || names[source.Name] {
+			HandleError(errMsg,
+				fmt.Errorf("source name '%s' is repeated or has a '/'. set a unique 'name' for each source", source.Name),
+				true)
+		}
+		names[source.Name] = true
+
+		if !IsReadOperation(op) {
+			continue
+		}
+
+		if source.ConsumerGroup == "" {
+			HandleError(errMsg,
+				fmt.Errorf("key 'consumerGroup' is missing in source '%s' and I'll not assume $default. really need a consumerGroup to be able to read", source.Name),
+				true)
+		}
+
+		if currentConfig.Transport == transportAmqp && source.EventhubConnectionString == "" {
+			HandleError(errMsg,
+				fmt.Errorf("key 'eventhubConnString' is missing or empty in source '%s'", source.Name),
+				true)
+		}
+	}
+}
+
+// validateExportRange checks that the bounds of the export range can be used together.
+// Will panic in case of failure.
+//
+// Parameters:
+//  errMsg: error message used if the configuration is invalid.
+//
+// Returns:
+//  Nothing.
+func validateExportRange(errMsg string) {
+	e := currentConfig.Export
+
+	if !e.From.IsZero() && !e.To.IsZero() && e.From.After(e.To) {
+		HandleError(errMsg, errors.New("key 'export.from' must not be after 'export.to'"), true)
+	}
+
+	if source, _ := e.GetPartition(); source != "" {
+		found := false
+		for _, configured := range currentConfig.Sources {
+			found = found || configured.Name == source
+		}
+		if !found {
+			HandleError(errMsg,
+				fmt.Errorf("source '%s' of key 'export.partition' does not exist", source),
+				true)
+		}
+	}
+
+	if (e.FromSequence != nil || e.ToSequence != nil) && e.Partition == "" {
+		HandleError(errMsg,
+			errors.New("keys 'export.fromSequence' and 'export.toSequence' need 'export.partition'"),
+			true)
+	}
+
+	if e.FromSequence != nil && e.ToSequence != nil && *e.FromSequence > *e.ToSequence {
+		HandleError(errMsg, errors.New("key 'export.fromSequence' must not be greater than 'export.toSequence'"), true)
+	}
+
+	if e.PropertyValue != "" && currentConfig.IndexProperty == "" {
+		HandleError(errMsg, errors.New("key 'export.propertyValue' needs 'indexProperty'"), true)
+	}
+}
+
+// validateRetention checks the retention policy and sets the defaults of the value log garbage collection.
+// Will panic in case of failure.
+//
+// Parameters:
+//  errMsg: error message used if the configuration is invalid.
+//  op: operation that will run.
+//
+// Returns:
+//  Nothing.
+func validateRetention(errMsg string, op string) {
+	retention := &currentConfig.Retention
+
+	var err error
+	if retention.MaxAge != "" {
+		retentionMaxAge, err = ParseRetentionAge(retention.MaxAge)
+		if err != nil || retentionMaxAge <= 0 {
+			HandleError(errMsg,
+				fmt.Errorf("value '%s' is not a valid age for key 'retention.maxAge'", retention.MaxAge),
+				true)
+		}
+	}
+
+	if retention.MaxSizeMB < 0 {
+		HandleError(errMsg, errors.New("key 'retention.maxSizeMB' must not be negative"), true)
+	}
+
+	if op == "prune" && retention.MaxAge == "" && retention.MaxSizeMB == 0 {
+		HandleError(errMsg,
+			errors.New("key 'retention' has no 'maxAge' nor 'maxSizeMB'. prune needs at least one"),
+			true)
+	}
+
+	if retention.GcInterval == "" {
+		retention.GcInterval = gcInterval
+	}
+
+	valueLogGcInterval, err = time.ParseDuration(retention.GcInterval)
+	if err != nil || valueLogGcInterval <= 0 {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not a valid duration for key 'retention.gcInterval'", retention.GcInterval),
+			true)
+	}
+
+	if retention.GcDiscardRatio == 0 {
+		retention.GcDiscardRatio = gcDiscardRatio
+	}
+
+	if retention.GcDiscardRatio <= 0 || retention.GcDiscardRatio >= 1 {
+		HandleError(errMsg,
+			errors.New("key 'retention.gcDiscardRatio' must be greater than 0 and lower than 1"),
+			true)
+	}
+}
+
+// validateCompression checks the compression of the badger blocks and of the stored payloads.
+// Will panic in case of failure.
+//
+// Parameters:
+//  errMsg: error message used if the configuration is invalid.
+//
+// Returns:
+//  Nothing.
+func validateCompression(errMsg string) {
+	supported := []string{storageCompressionNone, storageCompressionSnappy, storageCompressionZstd}
+
+	if currentConfig.BadgerCompression != "" && !Contains(supported, currentConfig.BadgerCompression) {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not valid for key 'badgerCompression'", currentConfig.BadgerCompression),
+			true)
+	}
+
+	if currentConfig.BadgerZstdLevel != 0 && currentConfig.BadgerCompression != storageCompressionZstd {
+		HandleError(errMsg, errors.New("key 'badgerZstdLevel' needs 'badgerCompression' to be 'zstd'"), true)
+	}
+
+	if currentConfig.StorageCompression == "" {
+		currentConfig.StorageCompression = storageCompressionNone
+	}
+
+	if !Contains(supported, currentConfig.StorageCompression) {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not valid for key 'storageCompression'", currentConfig.StorageCompression),
+			true)
+	}
+}
+
+// validateEncryption loads the encryption key and checks what the encryption operations need.
+// Will panic in case of failure.
+//
+// Parameters:
+//  errMsg: error message used if the configuration is invalid.
+//  op: operation that will run.
+//
+// Returns:
+//  Nothing.
+func validateEncryption(errMsg string, op string) {
+	encryption := &currentConfig.Encryption
+
+	if encryption.KeyFile != "" && encryption.KeyEnv != "" {
+		HandleError(errMsg, errors.New("keys 'encryption.keyFile' and 'encryption.keyEnv' can't be used together"), true)
+	}
+
+	var err error
+	encryptionKey, err = LoadEncryptionKey(encryption.KeyFile, encryption.KeyEnv)
+	if err != nil {
+		HandleError(errMsg, fmt.Errorf("encryption key is not valid: %v", err), true)
+	}
+
+	if encryption.EncryptFiles && encryptionKey == nil {
+		HandleError(errMsg, errors.New("key 'encryption.encryptFiles' needs 'encryption.keyFile' or 'encryption.keyEnv'"),
+			true)
+	}
+
+	if op == "decrypt" && encryptionKey == nil {
+		HandleError(errMsg, errors.New("decrypt needs 'encryption.keyFile' or 'encryption.keyEnv'"), true)
+	}
+
+	if op == "rotate-key" {
+		if encryptionKey == nil {
+			HandleError(errMsg,
+				errors.New("rotate-key needs the current key in 'encryption.keyFile' or 'encryption.keyEnv'. To encrypt "+
+					"a database created without a key, back it up, move the database away, set the key and restore it"),
+				true)
+		}
+		if encryption.NewKeyFile == "" && encryption.NewKeyEnv == "" {
+			HandleError(errMsg,
+				errors.New("rotate-key needs 'encryption.newKeyFile' or 'encryption.newKeyEnv' (or -new-key-file)"),
+				true)
+		}
+		if encryption.NewKeyFile != "" && encryption.NewKeyEnv != "" {
+			HandleError(errMsg,
+				errors.New("keys 'encryption.newKeyFile' and 'encryption.newKeyEnv' can't be used together"),
+				true)
+		}
+	}
+
+	if encryption.DataKeyRotation == "" {
+		encryption.DataKeyRotation = dataKeyRotation
+	}
+
+	dataKeyRotationDuration, err = ParseRetentionAge(encryption.DataKeyRotation)
+	if err != nil || dataKeyRotationDuration <= 0 {
+		HandleError(errMsg,
+			fmt.Errorf("value '%s' is not a valid duration for key 'encryption.dataKeyRotation'",
+				encryption.DataKeyRotation),
+			true)
+	}
+}
+
+// validateBackup checks the backup file and sets its default. A backup is only restored into the env and entity path
+// it was taken from, and encrypted backups need the encryption key.
+// Will panic in case of failure.
+//
+// Parameters:
+//  errMsg: error message used if the configuration is invalid.
+//  op: operation that will run.
+//
+// Returns:
+//  Nothing.
+func validateBackup(errMsg string, op string) {
+	if op == "backup" && currentConfig.Backup.File == "" {
+		currentConfig.Backup.File = GetDefaultBackupFile()
+	}
+
+	if op != "restore" {
+		return
+	}
+
+	if currentConfig.Backup.File == "" {
+		HandleError(errMsg, errors.New("restore needs 'backup.file' (or -backup-file)"), true)
+	}
+
+	for _, file := range []string{currentConfig.Backup.File, GetBackupManifestPath(currentConfig.Backup.File)} {
+		if !FileOrDirExists(file) {
+			HandleError(errMsg, fmt.Errorf("file '%s' does not exist", file), true)
+		}
+	}
+
+	manifest := ReadBackupManifest(currentConfig.Backup.File)
+	if manifest.Env != currentConfig.Env || manifest.EntityPath != currentConfig.EntityPath {
+		HandleError(errMsg,
+			fmt.Errorf("the backup was taken from env '%s' (entity path '%s') and can't be restored into env '%s' "+
+				"(entity path '%s')", manifest.Env, manifest.EntityPath, currentConfig.Env, currentConfig.EntityPath),
+			true)
+	}
+
+	if manifest.Encrypted && encryptionKey == nil {
+		HandleError(errMsg,
+			errors.New("the backup is encrypted: restore needs 'encryption.keyFile' or 'encryption.keyEnv'"),
+			true)
+	}
+}
+
+// IsReadOperation checks if an operation receives messages from eventhub.
+//
+// Parameters:
+//  op: desired operation.
+//
+// Returns:
+//  true if the operation receives messages. false otherwise.
+func IsReadOperation(op string) bool {
+	return op == "read" || op == "tail"
+}
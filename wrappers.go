@@ -37,7 +37,7 @@ func WrapUpExecution() {
 // Returns:
 //  Nothing
 func PrepareToRun() string {
-	exitCode = 1
+	exitCode = exitCodeFailure
 	op, cfgFile := ParseCommandLine()
 	op = strings.ToLower(op)
 	if !FileOrDirExists(cfgFile) {
@@ -48,6 +48,7 @@ func PrepareToRun() string {
 	}
 
 	LoadConfig(cfgFile)
+	ApplyCommandLineArgs()
 	ValidateRunConfiguration(cfgFile, op)
 	return op
 }
@@ -90,3 +91,68 @@ func WaitForUserInterruption() {
 	<-signalChan
 	WrapUpExecution()
 }
+
+// WaitForReadToFinish will wait until the read operation reaches one of its bounds (max messages, max duration or
+// caught up) or the user interrupts the execution.
+//
+// Parameters:
+//  None
+//
+// Returns:
+//  Nothing.
+func WaitForReadToFinish() {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, os.Kill)
+	defer signal.Stop(signalChan)
+
+	var timeout <-chan time.Time
+	if maxReadDuration > 0 {
+		timeout = time.After(maxReadDuration)
+	}
+
+	select {
+	case <-signalChan:
+		readStats.Stop(stopReasonInterrupted)
+
+	case <-timeout:
+		readStats.Stop(stopReasonMaxDuration)
+
+	case <-readStats.Stopped():
+		break
+	}
+}
+
+// RunGracefulShutdown runs the steps needed to stop an operation without losing data. If they take longer than
+// the configured timeout, or if the user interrupts the execution again, gives up and exits right away.
+//
+// Parameters:
+//  shutdown: function with the steps needed to stop the operation.
+//
+// Returns:
+//  Nothing.
+func RunGracefulShutdown(shutdown func()) {
+	log.Printf("Shutting down... (press Ctrl+C again to force it, timeout: %s)\n", gracefulShutdownTimeout)
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, os.Kill)
+	defer signal.Stop(signalChan)
+
+	done := make(chan struct{})
+	go func() {
+		shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+
+	case <-signalChan:
+		log.Println("Shutdown interrupted by the user. Some messages may have not been saved.")
+
+	case <-time.After(gracefulShutdownTimeout):
+		log.Println("Shutdown timed out. Some messages may have not been saved.")
+	}
+
+	exitCode = exitCodeFailure
+	WrapUpExecution()
+}